@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultAuditLimit is the default max number of records returned by /admin/audit.
+const DefaultAuditLimit = 100
+
+// AuditRecord is a record of the audit log: a mutating request and its outcome.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Key       string    `json:"key,omitempty"` // Key of the request (as stored, with its bucket), if it has one
+	ClientIP  string    `json:"client_ip"`
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// AuditLog keeps the records of the last mutating requests (PUT, POST, PATCH and DELETE)
+// in a ring buffer.
+// Unlike the request log, it's structured and can be queried (see Records).
+//
+// Its methods are safe for concurrent use.
+type AuditLog struct {
+	mux     sync.Mutex
+	records []AuditRecord // Ring buffer of the records, at most cap(records)
+	start   int           // Index of the oldest record in records (once it's full)
+}
+
+// NewAuditLog creates a new AuditLog keeping the last size records.
+func NewAuditLog(size int) *AuditLog {
+	return &AuditLog{records: make([]AuditRecord, 0, size)}
+}
+
+// add adds rec to the log, dropping the oldest record if the log is full.
+func (al *AuditLog) add(rec AuditRecord) {
+	al.mux.Lock()
+	defer al.mux.Unlock()
+
+	if len(al.records) < cap(al.records) {
+		al.records = append(al.records, rec)
+	} else if len(al.records) > 0 {
+		al.records[al.start] = rec
+		al.start = (al.start + 1) % len(al.records)
+	}
+}
+
+// Records returns at most limit records of key (all keys if empty) recorded after since,
+// oldest first.
+func (al *AuditLog) Records(key string, since time.Time, limit int) []AuditRecord {
+	al.mux.Lock()
+	defer al.mux.Unlock()
+
+	recs := []AuditRecord{}
+	for i := range al.records {
+		rec := &al.records[(al.start+i)%len(al.records)]
+		if (key == "" || rec.Key == key) && rec.Time.After(since) {
+			if len(recs) == limit {
+				break
+			}
+			recs = append(recs, *rec)
+		}
+	}
+	return recs
+}
+
+// audit records r in s.Audit (if set) if it's a mutating request, with the response status.
+// It's called after the request is served, so no locks of the store are held.
+func (s *Server) audit(r *http.Request, status int) {
+	if s.Audit == nil || !isMutating(r.Method) {
+		return
+	}
+
+	var ip string
+	if s.RateLimiter != nil {
+		ip = s.RateLimiter.clientIP(r) // Honors -trust-forwarded-for
+	} else if ip, _, _ = net.SplitHostPort(r.RemoteAddr); ip == "" {
+		ip = r.RemoteAddr
+	}
+	s.Audit.add(AuditRecord{
+		Time:      time.Now(),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Key:       keyOf(r),
+		ClientIP:  ip,
+		Status:    status,
+		RequestID: RequestID(r.Context()),
+	})
+}
+
+// adminAuditHandler is a request handler which handles the endpoint
+// mapped to /admin/audit, returning the records of the audit log.
+func (s *Server) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if !s.checkAdmin(w, r) {
+		return
+	}
+	if s.Audit == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	// GET /admin/audit?key={key}&since={time}&limit={limit}
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			badRequest(w, "Invalid since parameter (must be an RFC 3339 timestamp)!")
+			return
+		}
+	}
+	limit := DefaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > s.MaxBulkKeys {
+			badRequest(w, "Invalid limit parameter (must be a positive integer, at most the max bulk keys)!")
+			return
+		}
+	}
+
+	sendJSON(w, s.Audit.Records(q.Get("key"), since, limit))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Buckets give applications sharing a server their own key spaces: the endpoints
+// /{bucket}/values/ and /{bucket}/reservations/ work like /values/ and /reservations/,
+// but on the keys of {bucket}.
+//
+// Keys of a bucket are stored as "{bucket}/{key}". Since keys may not contain slashes,
+// they can't collide with keys of other buckets (nor with keys outside of buckets).
+// Keys given in the key query parameter may contain slashes (see byQueryKey): those are
+// stored with a leading slash ("/{key}"), so they can't collide with keys of buckets either.
+
+// bucketKey is the context key of the bucket of a request.
+type bucketKey struct{}
+
+// inBucket returns the key under which key of the bucket of r (if any) is stored.
+func inBucket(r *http.Request, key string) string {
+	if bucket, _ := r.Context().Value(bucketKey{}).(string); bucket != "" {
+		return bucket + "/" + key
+	}
+	if strings.IndexByte(key, '/') >= 0 {
+		return "/" + key // A query key, see byQueryKey
+	}
+	return key
+}
+
+// requestPath returns the (escaped) path of r as requested by the client,
+// including the bucket of r (if any). If the key of r is given in the query
+// (see byQueryKey), the key query parameter is included.
+func requestPath(r *http.Request) string {
+	if queryKey, _ := r.Context().Value(queryKeyKey{}).(bool); queryKey {
+		return PathValueQuery + "?" + url.Values{"key": {r.URL.Query().Get("key")}}.Encode()
+	}
+	if bucket, _ := r.Context().Value(bucketKey{}).(string); bucket != "" {
+		return "/" + url.PathEscape(bucket) + r.URL.EscapedPath()
+	}
+	return r.URL.EscapedPath()
+}
+
+// checkStoredKey checks key as stored in the store: either a key, a key of a bucket,
+// or a query key having slashes.
+func (s *Server) checkStoredKey(key string) error {
+	if k, ok := strings.CutPrefix(key, "/"); ok {
+		switch {
+		case k == "":
+			return ErrKeyMissing
+		case len(k) > s.MaxKeyLength:
+			return ErrKeyTooLong
+		}
+		return nil
+	}
+	if bucket, k, ok := strings.Cut(key, "/"); ok {
+		if err := s.checkKey(bucket); err != nil {
+			return err
+		}
+		return s.checkKey(k)
+	}
+	return s.checkKey(key)
+}
+
+// Buckets returns the names of the buckets having keys, sorted.
+func (s *Store) Buckets() []string {
+	set := make(map[string]struct{})
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		for key := range sh.m {
+			if bucket, _, ok := strings.Cut(key, "/"); ok && bucket != "" { // Not a query key
+				set[bucket] = struct{}{}
+			}
+		}
+		sh.mux.RUnlock()
+	}
+	buckets := make([]string, 0, len(set))
+	for bucket := range set {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// bucketHandler is a request handler which handles the endpoints
+// mapped to /{bucket}/values/ and /{bucket}/reservations/, passing them
+// on to the handlers of the endpoints with the bucket in the request context.
+// Other (unknown) endpoints are handled by notFoundHandler.
+func (s *Server) bucketHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	escBucket, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	rest = "/" + rest
+	var handler http.HandlerFunc
+	switch {
+	case !ok:
+	case strings.HasPrefix(rest, PathValues):
+		handler = s.valuesHandler
+	case strings.HasPrefix(rest, PathReservations):
+		handler = s.reservationsHandler
+	}
+	if handler == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	bucket, err := url.PathUnescape(escBucket)
+	if err != nil {
+		badRequest(w, "Invalid escaping in path!")
+		return
+	}
+	if err := s.checkKey(bucket); err != nil {
+		sendKeyError(w, err)
+		return
+	}
+
+	// Strip the bucket from the path, so the handlers see the usual paths
+	r2 := r.WithContext(context.WithValue(r.Context(), bucketKey{}, bucket))
+	u := *r.URL
+	u.RawPath = rest
+	if u.Path, err = url.PathUnescape(rest); err != nil {
+		badRequest(w, "Invalid escaping in path!")
+		return
+	}
+	r2.URL = &u
+	handler(w, r2)
+}
+
+// bucketsHandler is a request handler which handles the endpoint
+// mapped to /buckets, listing the buckets having keys.
+func (s *Server) bucketsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	sendJSON(w, s.store.Buckets())
+}
@@ -0,0 +1,133 @@
+package main
+
+import "sync/atomic"
+
+// SetMaxBytes limits the total size of the values to maxBytes (0 means no limit).
+// Writes which would exceed it first evict the least recently used unlocked keys,
+// and fail with ErrInsufficientStorage if that's not enough (locked keys are never evicted).
+// The total is approximate: values are counted as stored (compressed if compression
+// is enabled), keys and bookkeeping are not counted.
+// It must be called before the store is used.
+func (s *Store) SetMaxBytes(maxBytes int64) {
+	s.maxBytes = maxBytes
+	if maxBytes > 0 && s.lru == nil {
+		s.lru = newLRU() // For eviction, the key count is not limited
+	}
+}
+
+// setValue sets the value of vw, keeping the total size of the values up to date.
+// The shard of vw must be locked by the caller.
+func (s *Store) setValue(vw *valueWr, value string) {
+	old := len(vw.data)
+	vw.set(value, s.compressMin)
+	atomic.AddInt64(&s.bytes, int64(len(vw.data)-old))
+}
+
+// dropValue accounts for vw being deleted from the store.
+// The shard of vw must be locked by the caller.
+func (s *Store) dropValue(vw *valueWr) {
+	atomic.AddInt64(&s.bytes, -int64(len(vw.data)))
+}
+
+// fits tells if the value of vw can be set to a value of size bytes within the memory budget.
+// Since values are checked before they are compressed, this is conservative.
+// The shard of vw must be locked by the caller.
+func (s *Store) fits(vw *valueWr, size int) bool {
+	return s.maxBytes == 0 || atomic.LoadInt64(&s.bytes)+int64(size-len(vw.data)) <= s.maxBytes
+}
+
+// wouldFit tells if the value of key could be set to a value of size bytes within the
+// memory budget by a write which makes room first (see makeRoom): counting only the values
+// which can't be evicted (locked keys, and key itself). It's for dry runs, nothing is evicted.
+// No shard may be locked by the caller.
+func (s *Store) wouldFit(key string, size int) bool {
+	if s.maxBytes == 0 {
+		return true
+	}
+	if int64(size) > s.maxBytes {
+		return false
+	}
+	if atomic.LoadInt64(&s.bytes)+int64(size) <= s.maxBytes {
+		return true
+	}
+	var kept int64 // Size of the values which can't be evicted, key's current value excluded
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		for k, vw := range sh.m {
+			if k != key && (vw.held || len(vw.waiters) > 0) {
+				kept += int64(len(vw.data))
+			}
+		}
+		sh.mux.RUnlock()
+	}
+	return kept+int64(size) <= s.maxBytes
+}
+
+// fitsAll tells if values can be set (replacing the current values of their keys,
+// or all values if replace is true) within the memory budget.
+// All shards must be locked by the caller.
+func (s *Store) fitsAll(values map[string]string, replace bool) bool {
+	if s.maxBytes == 0 {
+		return true
+	}
+	total := atomic.LoadInt64(&s.bytes)
+	if replace {
+		total = 0
+	}
+	for key, value := range values {
+		total += int64(len(value))
+		if vw := s.shard(key).m[key]; vw != nil && !replace {
+			total -= int64(len(vw.data))
+		}
+	}
+	return total <= s.maxBytes
+}
+
+// valuesSize returns the total size of values.
+func valuesSize(values map[string]string) (size int) {
+	for _, value := range values {
+		size += len(value)
+	}
+	return size
+}
+
+// valuesKeys returns the keys of values.
+func valuesKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// makeRoom evicts the least recently used unlocked keys until size more bytes
+// fit in the memory budget (or there are no more unlocked keys). Nothing is evicted
+// if size doesn't fit in the budget even in an empty store.
+// The keys being written are never evicted (they would just be recreated).
+// No shard may be locked by the caller.
+func (s *Store) makeRoom(size int, writing ...string) {
+	if s.maxBytes == 0 || int64(size) > s.maxBytes {
+		return
+	}
+	if atomic.LoadInt64(&s.bytes)+int64(size) <= s.maxBytes {
+		return
+	}
+	skip := make(map[string]bool, len(writing))
+	for _, key := range writing {
+		skip[key] = true
+	}
+	for n := 16; atomic.LoadInt64(&s.bytes)+int64(size) > s.maxBytes; n *= 2 {
+		keys := s.lru.oldest(n)
+		for _, key := range keys {
+			if atomic.LoadInt64(&s.bytes)+int64(size) <= s.maxBytes {
+				return
+			}
+			if !skip[key] {
+				s.evictKey(key)
+			}
+		}
+		if len(keys) < n {
+			return // Checked all keys, the rest is locked
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaxBytes(t *testing.T) {
+	s := newTestServer()
+	s.AdminToken = "secret"
+	s.store.SetMaxBytes(10)
+	lockId := put(t, s, "a", "12345") // Locked, never evicted
+	if err := s.store.Release("b", put(t, s, "b", "12345")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Full: b is evicted to make room.
+	if w := do(s, http.MethodPut, PathValues+"c", "123"); w.Code != http.StatusCreated {
+		t.Fatalf("Eviction: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if _, err := s.store.Get("b"); err != ErrNotFound {
+		t.Errorf("Got error %v for b, want it evicted", err)
+	}
+
+	// Can't make room: a is locked, and c is not enough.
+	w := do(s, http.MethodPut, PathValues+"d", "12345678")
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusInsufficientStorage)
+	} else if code := errorCode(t, w); code != CodeInsufficientStorage {
+		t.Errorf("Got code %q, want %q", code, CodeInsufficientStorage)
+	}
+	if value, _ := s.store.Get("a"); value != "12345" {
+		t.Errorf("Got value %q for locked a, want %q", value, "12345")
+	}
+	for _, c := range []struct{ method, target, body string }{
+		{http.MethodPut, PathBulk, `{"e": "12345678", "f": "1"}`},
+		{http.MethodPost, PathImport, `{"key": "e", "value": "12345678"}`},
+	} {
+		var w *httptest.ResponseRecorder
+		if c.target == PathImport {
+			w = importAs(s, c.target, "secret", c.body)
+		} else {
+			w = do(s, c.method, c.target, c.body)
+		}
+		if w.Code != http.StatusInsufficientStorage {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.target, w.Code, http.StatusInsufficientStorage)
+		}
+	}
+	if _, err := s.store.Get("e"); err != ErrNotFound {
+		t.Errorf("Got error %v for e, want nothing set", err)
+	}
+
+	// Deleting frees up space.
+	if w := do(s, http.MethodDelete, PathValues+"a/"+lockId, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: got status %d", w.Code)
+	}
+	if w := do(s, http.MethodPut, PathValues+"d", "1234567"); w.Code != http.StatusCreated {
+		t.Errorf("After delete: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if stats := s.store.Stats(); stats.ValueBytes > 10 {
+		t.Errorf("Got %d bytes stored, over the budget", stats.ValueBytes)
+	}
+}
+
+func TestMaxBytesOverwrite(t *testing.T) {
+	s := newTestServer()
+	s.store.SetMaxBytes(10)
+	for _, key := range []string{"a", "b"} {
+		if err := s.store.Release(key, put(t, s, key, "12345")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a is the least recently used, but it is the one being written: b is evicted.
+	if w := do(s, http.MethodPut, PathValues+"a", "1234567"); w.Code != http.StatusOK {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if value, err := s.store.Get("a"); err != nil || value != "1234567" {
+		t.Errorf("Got value %q (%v) for a, want %q", value, err, "1234567")
+	}
+	if _, err := s.store.Get("b"); err != ErrNotFound {
+		t.Errorf("Got error %v for b, want it evicted", err)
+	}
+}
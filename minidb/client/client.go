@@ -0,0 +1,229 @@
+/*
+Package client is a Go client of the minidb server.
+
+A Client wraps the HTTP calls of the endpoints:
+
+	c := client.New("http://localhost:8080")
+	lockId, err := c.Set(ctx, "counter", "1")
+	...
+	err = c.Release(ctx, "counter", lockId)
+
+Error responses of the server are returned as *Error, which can be tested
+against ErrNotFound, ErrLocked etc. with errors.Is.
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Errors reported by the server, to be tested with errors.Is.
+var (
+	ErrNotFound     = errors.New("key not found")
+	ErrLocked       = errors.New("key is locked")
+	ErrUnauthorized = errors.New("lock id does not identify the currently held lock")
+	ErrExpired      = errors.New("lock has expired")
+	ErrTimeout      = errors.New("timed out waiting for the lock")
+)
+
+// codeErrs maps the error codes of the server to the errors.
+var codeErrs = map[string]error{
+	"not_found":    ErrNotFound,
+	"locked":       ErrLocked,
+	"unauthorized": ErrUnauthorized,
+	"expired":      ErrExpired,
+	"timeout":      ErrTimeout,
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int    // HTTP status code of the response
+	Code       string // Machine-readable error code (e.g. "locked")
+	Message    string // Human-readable error message
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("minidb: %s (status: %d, code: %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// Is tells if e corresponds to target (one of ErrNotFound, ErrLocked etc.).
+func (e *Error) Is(target error) bool {
+	return codeErrs[e.Code] == target
+}
+
+// Client is a client of a minidb server.
+// Its methods are safe for concurrent use.
+type Client struct {
+	baseURL string       // Base URL of the server, without trailing slash
+	hc      *http.Client // HTTP client doing the requests
+
+	maxAttempts int           // Max attempts of reservations, 1 means no retry, 0 means until ctx is done
+	baseDelay   time.Duration // Delay before the first retry, doubled for each further retry
+}
+
+// Option configures a Client.
+type Option func(c *Client)
+
+// WithHTTPClient sets the HTTP client doing the requests (http.DefaultClient by default).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.hc = hc
+	}
+}
+
+// WithRetry makes reservations retry with exponential backoff (with jitter) if key is locked
+// (TryReserve) or the lock couldn't be acquired in time: the first retry is after about
+// baseDelay, doubled for each further retry. At most maxAttempts attempts are made
+// (0 means no limit), but never after the context of the call is done.
+func WithRetry(maxAttempts int, baseDelay time.Duration) Option {
+	return func(c *Client) {
+		c.maxAttempts, c.baseDelay = maxAttempts, baseDelay
+	}
+}
+
+// New creates a new Client of the server at baseURL (e.g. "http://localhost:8080").
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		hc:      http.DefaultClient,
+
+		maxAttempts: 1,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Reserve waits for key to be available and acquires its lock.
+// Returns the lock id and the value of key.
+// Returns ErrTimeout if the server times out waiting (see WithRetry).
+func (c *Client) Reserve(ctx context.Context, key string) (lockId, value string, err error) {
+	return c.reserve(ctx, key, nil)
+}
+
+// TryReserve is like Reserve, but it doesn't wait if key is locked:
+// ErrLocked is returned instead (see WithRetry).
+func (c *Client) TryReserve(ctx context.Context, key string) (lockId, value string, err error) {
+	return c.reserve(ctx, key, url.Values{"wait": {"false"}})
+}
+
+// reserve acquires the lock of key with the given query, retrying as configured by WithRetry.
+func (c *Client) reserve(ctx context.Context, key string, query url.Values) (lockId, value string, err error) {
+	var resp struct {
+		LockId string `json:"lock_id"`
+		Value  string `json:"value"`
+	}
+	delay := c.baseDelay
+	for attempt := 1; ; attempt++ {
+		err = c.do(ctx, http.MethodPost, "/reservations/"+url.PathEscape(key), query, "", &resp)
+		if !errors.Is(err, ErrLocked) && !errors.Is(err, ErrTimeout) {
+			break
+		}
+		if attempt == c.maxAttempts {
+			break
+		}
+		// Jitter: wait between half and all of delay, so contending clients spread out
+		jittered := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(jittered):
+		case <-ctx.Done():
+			return "", "", err
+		}
+		delay *= 2
+	}
+	return resp.LockId, resp.Value, err
+}
+
+// Set waits for key to be available and acquires its lock (creating key if it doesn't
+// exist), then sets its value. Returns the lock id.
+func (c *Client) Set(ctx context.Context, key, value string) (lockId string, err error) {
+	var resp struct {
+		LockId string `json:"lock_id"`
+	}
+	err = c.do(ctx, http.MethodPut, "/values/"+url.PathEscape(key), nil, value, &resp)
+	return resp.LockId, err
+}
+
+// Update sets the value of key locked by lockId, and releases the lock if release is true.
+func (c *Client) Update(ctx context.Context, key, lockId, value string, release bool) error {
+	q := url.Values{"release": {fmt.Sprint(release)}}
+	return c.do(ctx, http.MethodPost, "/values/"+url.PathEscape(key)+"/"+url.PathEscape(lockId), q, value, nil)
+}
+
+// Release releases the lock of key identified by lockId, leaving its value unchanged.
+func (c *Client) Release(ctx context.Context, key, lockId string) error {
+	body, err := json.Marshal(map[string]string{key: lockId})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodDelete, "/reservations", nil, string(body), nil)
+}
+
+// Get returns the value of key. It does not touch the lock of key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var resp struct {
+		Value string `json:"value"`
+	}
+	err := c.do(ctx, http.MethodGet, "/values/"+url.PathEscape(key), nil, "", &resp)
+	return resp.Value, err
+}
+
+// do does a request with the given method, path, query and body.
+// If the response is successful and result is not nil, the JSON response is decoded into it.
+// Error responses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body string, result interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body) // So the connection can be reused
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("minidb: invalid response: %w", err)
+	}
+	return nil
+}
+
+// decodeError decodes the error envelope of the error response resp.
+func decodeError(resp *http.Response) error {
+	var env struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	e := &Error{StatusCode: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err == nil {
+		e.Code, e.Message = env.Error.Code, env.Error.Message
+	} else {
+		e.Message = http.StatusText(resp.StatusCode) // Not our envelope, e.g. from a proxy
+	}
+	return e
+}
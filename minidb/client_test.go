@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icza/go-progprobs/minidb/client"
+)
+
+// clientServer is a Server counting the reservation requests of the clients.
+// Reservations wait for the lock 10ms at most (unless a timeout is given),
+// so reservations of locked keys time out quickly.
+type clientServer struct {
+	*Server
+	reservations int64 // Number of reservation requests
+}
+
+// newClientServer starts a clientServer, and returns it and a Client of it configured by opts.
+func newClientServer(t *testing.T, opts ...client.Option) (*clientServer, *client.Client) {
+	cs := &clientServer{Server: newTestServer()}
+	ts := httptest.NewServer(cs)
+	t.Cleanup(ts.Close)
+	return cs, client.New(ts.URL, append([]client.Option{client.WithHTTPClient(ts.Client())}, opts...)...)
+}
+
+func (cs *clientServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, PathReservations) {
+		atomic.AddInt64(&cs.reservations, 1)
+		if q := r.URL.Query(); q.Get("timeout") == "" {
+			q.Set("timeout", "10ms")
+			r.URL.RawQuery = q.Encode()
+		}
+	}
+	cs.Server.ServeHTTP(w, r)
+}
+
+func TestClient(t *testing.T) {
+	_, c := newClientServer(t)
+	ctx := context.Background()
+	wrongId, err := genLockId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockId, err := c.Set(ctx, "a b", "1")
+	if err != nil || lockId == "" {
+		t.Fatalf("Set: got lock id %q, error %v", lockId, err)
+	}
+	if value, err := c.Get(ctx, "a b"); err != nil || value != "1" {
+		t.Errorf("Get: got %q, %v, want %q", value, err, "1")
+	}
+	if _, _, err := c.TryReserve(ctx, "a b"); !errors.Is(err, client.ErrLocked) {
+		t.Errorf("TryReserve: got error %v, want %v", err, client.ErrLocked)
+	}
+	if _, _, err := c.Reserve(ctx, "a b"); !errors.Is(err, client.ErrTimeout) {
+		t.Errorf("Reserve: got error %v, want %v", err, client.ErrTimeout)
+	}
+
+	err = c.Update(ctx, "a b", wrongId, "2", true)
+	var e *client.Error
+	if !errors.Is(err, client.ErrUnauthorized) || !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Update with wrong lock id: got error %v, want %v", err, client.ErrUnauthorized)
+	}
+	if err := c.Update(ctx, "a b", lockId, "2", false); err != nil {
+		t.Errorf("Update: %v", err)
+	}
+	if err := c.Release(ctx, "a b", lockId); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+	if err := c.Release(ctx, "a b", lockId); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Second release: got error %v, want %v", err, client.ErrUnauthorized)
+	}
+
+	lockId, value, err := c.Reserve(ctx, "a b")
+	if err != nil || lockId == "" || value != "2" {
+		t.Errorf("Reserve: got lock id %q, value %q, error %v, want value %q", lockId, value, err, "2")
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Get missing: got error %v, want %v", err, client.ErrNotFound)
+	}
+}
+
+func TestClientForeignError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	_, err := client.New(ts.URL).Get(context.Background(), "a")
+	var e *client.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadGateway || e.Message != http.StatusText(http.StatusBadGateway) {
+		t.Errorf("Got error %#v, want *Error with status %d", err, http.StatusBadGateway)
+	}
+}
+
+// attempts returns the number of reservation requests.
+func (cs *clientServer) attempts() int64 {
+	return atomic.LoadInt64(&cs.reservations)
+}
+
+func TestReserveRetry(t *testing.T) {
+	ctx := context.Background()
+	for _, try := range []bool{true, false} {
+		cs, c := newClientServer(t, client.WithRetry(0, 5*time.Millisecond))
+		lockId, err := c.Set(ctx, "a", "1")
+		if err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		time.AfterFunc(50*time.Millisecond, func() { cs.store.Release("a", lockId) })
+
+		reserve := c.Reserve
+		if try {
+			reserve = c.TryReserve
+		}
+		if _, value, err := reserve(ctx, "a"); err != nil || value != "1" {
+			t.Errorf("try=%t: got value %q, error %v, want %q", try, value, err, "1")
+		}
+		if n := cs.attempts(); n < 2 {
+			t.Errorf("try=%t: got %d attempts, want retries", try, n)
+		}
+	}
+}
+
+func TestReserveRetryLimits(t *testing.T) {
+	ctx := context.Background()
+
+	// Max attempts
+	cs, c := newClientServer(t, client.WithRetry(3, time.Millisecond))
+	c.Set(ctx, "a", "1")
+	if _, _, err := c.TryReserve(ctx, "a"); !errors.Is(err, client.ErrLocked) {
+		t.Errorf("Got error %v, want %v", err, client.ErrLocked)
+	}
+	if n := cs.attempts(); n != 3 {
+		t.Errorf("Got %d attempts, want 3", n)
+	}
+
+	// No retry by default
+	cs, c = newClientServer(t)
+	c.Set(ctx, "a", "1")
+	c.TryReserve(ctx, "a")
+	if n := cs.attempts(); n != 1 {
+		t.Errorf("Got %d attempts without retry, want 1", n)
+	}
+
+	// Context deadline
+	_, c = newClientServer(t, client.WithRetry(0, 10*time.Millisecond))
+	c.Set(ctx, "a", "1")
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// The deadline may also interrupt a request.
+	if _, _, err := c.TryReserve(ctx, "a"); !errors.Is(err, client.ErrLocked) && !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got error %v, want %v or %v", err, client.ErrLocked, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retried for %v, beyond the context deadline", elapsed)
+	}
+}
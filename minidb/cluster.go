@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const (
+	ringReplicas     = 100                    // Number of points of each node on the hash ring
+	HeaderForwarded  = "X-Minidb-Forwarded"   // Header marking requests proxied by a peer
+	HeaderPeerSecret = "X-Minidb-Peer-Secret" // Header of the shared secret of the peers, authenticating forwarded requests
+)
+
+// Ring is a consistent hash ring mapping keys to nodes: each node has ringReplicas points
+// on the ring, and a key is owned by the node of the first point following the hash of the key.
+// A Ring is immutable, so it's safe for concurrent use.
+type Ring struct {
+	hashes []uint32          // Points of the nodes on the ring, sorted
+	nodes  map[uint32]string // Nodes by their points
+}
+
+// NewRing creates a new Ring of the given nodes.
+func NewRing(nodes []string) *Ring {
+	r := &Ring{nodes: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < ringReplicas; i++ {
+			h := ringHash(strconv.Itoa(i) + "#" + node)
+			if _, ok := r.nodes[h]; ok {
+				continue // Collision, extremely rare: the first node keeps the point
+			}
+			r.nodes[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the node owning key.
+func (r *Ring) Owner(key string) string {
+	h := ringHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0 // Wrap around
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+// ringHash returns the point of s on the ring.
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// SetPeers makes s a node of a cluster: peers are the base URLs of all the nodes
+// (e.g. "http://node1:8080"), self is the base URL of s (one of peers), secret is
+// the secret shared by the nodes, authenticating the requests they proxy to each other.
+// Requests for keys owned by other nodes are proxied to them.
+// Membership is static: all nodes must be given the same peers, and keys are not moved
+// when the peers change. Endpoints without a key (e.g. /stats, /export, /bulk) only cover
+// the keys of the node serving them.
+// It must be called before s is used.
+func (s *Server) SetPeers(peers []string, self, secret string) error {
+	if secret == "" {
+		return errors.New("peer secret is required")
+	}
+	s.peerProxies = make(map[string]*httputil.ReverseProxy, len(peers))
+	for _, peer := range peers {
+		if peer == self {
+			continue
+		}
+		u, err := url.Parse(peer)
+		if err != nil {
+			return err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Failed to proxy %s %s to peer %s: %v", r.Method, r.URL.Path, peer, err)
+			writeError(w, http.StatusBadGateway, CodePeerUnavailable, "Peer owning the key is unavailable!")
+		}
+		s.peerProxies[peer] = proxy
+	}
+	s.ring, s.self, s.peerSecret = NewRing(peers), self, secret
+	return nil
+}
+
+// route returns a handler which proxies the requests of next for keys owned by other nodes
+// to their owners (if s is a node of a cluster, see SetPeers), and mutating requests to the
+// primary (if s is a read replica, see SetPrimary), and serves the rest locally.
+// Requests without a key, and requests already proxied by a peer are always served locally
+// (the latter so nodes with different peer lists can't bounce requests forever).
+// Only requests carrying the peer secret count as proxied by a peer, so clients can't
+// bypass the owners of keys.
+func (s *Server) route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.primary != nil && isMutating(r.Method) {
+			// Read replica: writes go to the primary
+			s.forward(s.primary, w, r)
+			return
+		}
+		if s.ring == nil || s.fromPeer(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := keyOf(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner := s.ring.Owner(key)
+		if owner == s.self {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.forward(s.peerProxies[owner], w, r)
+	})
+}
+
+// fromPeer tells if r is proxied by a peer, checking the peer secret.
+// The forwarding headers are removed from r, so they are neither trusted from
+// clients nor passed on.
+func (s *Server) fromPeer(r *http.Request) bool {
+	secret := r.Header.Get(HeaderPeerSecret)
+	ok := r.Header.Get(HeaderForwarded) != "" &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(s.peerSecret)) == 1
+	r.Header.Del(HeaderForwarded)
+	r.Header.Del(HeaderPeerSecret)
+	return ok
+}
+
+// forward proxies r with proxy, marking it as forwarded.
+func (s *Server) forward(proxy *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) {
+	if s.self != "" {
+		r.Header.Set(HeaderForwarded, s.self)
+		r.Header.Set(HeaderPeerSecret, s.peerSecret)
+	}
+	if id := RequestID(r.Context()); id != "" {
+		r.Header.Set(HeaderRequestID, id) // Same ID on both nodes, for tracing
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedFromClient(t *testing.T) {
+	proxied := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		if r.Header.Get(HeaderPeerSecret) != "secret" {
+			t.Errorf("Got peer secret %q, want %q", r.Header.Get(HeaderPeerSecret), "secret")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer peer.Close()
+
+	s := newTestServer()
+	if err := s.SetPeers([]string{"http://self", peer.URL}, "http://self", "secret"); err != nil {
+		t.Fatalf("SetPeers: %v", err)
+	}
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprint("key", i); s.ring.Owner(k) == peer.URL {
+			key = k
+		}
+	}
+	get := func(secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, PathValues+key, nil)
+		r.Header.Set(HeaderForwarded, "http://other")
+		if secret != "" {
+			r.Header.Set(HeaderPeerSecret, secret)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without the secret the header is not trusted: the request goes to the owner.
+	for _, secret := range []string{"", "wrong"} {
+		if w := get(secret); w.Code != http.StatusNoContent || proxied != 1 {
+			t.Errorf("Secret %q: got status %d, proxied %d times, want proxied to the owner", secret, w.Code, proxied)
+		}
+		proxied = 0
+	}
+
+	// Requests proxied by a peer are served locally.
+	if w := get("secret"); w.Code != http.StatusNotFound || proxied != 0 {
+		t.Errorf("From peer: got status %d, proxied %d times, want served locally", w.Code, proxied)
+	}
+
+	if err := newTestServer().SetPeers([]string{"http://self"}, "http://self", ""); err == nil {
+		t.Error("SetPeers accepted an empty secret")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipWriter is an http.ResponseWriter which compresses the response with gzip
+// if it is at least minSize bytes. The beginning of the response is buffered
+// until it is decided whether to compress it.
+//
+// Flushing decides right away: a response which is flushed before reaching minSize
+// (e.g. a stream) is sent uncompressed.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int          // Status code to send, 0 if not yet set
+	buf     []byte       // Buffered beginning of the response while not decided
+	decided bool         // Tells if it's decided whether to compress
+	gz      *gzip.Writer // Compressor if compressing
+}
+
+// WriteHeader implements http.ResponseWriter.
+// The header is only sent when it's decided whether to compress.
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.decided || gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(status) // Let the wrapped writer handle superfluous calls
+		return
+	}
+	gw.status = status
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		gw.decide(false) // No body
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if !gw.decided {
+		if gw.Header().Get("Content-Encoding") != "" ||
+			strings.HasPrefix(gw.Header().Get("Content-Type"), "text/event-stream") {
+			gw.decide(false) // Already encoded, or a stream
+		} else {
+			gw.buf = append(gw.buf, p...)
+			if len(gw.buf) >= gw.minSize {
+				if err := gw.decide(true); err != nil {
+					return 0, err
+				}
+			}
+			return len(p), nil
+		}
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+	return gw.ResponseWriter.Write(p)
+}
+
+// decide decides whether to compress the response, sends the header and the buffered data.
+func (gw *gzipWriter) decide(compress bool) error {
+	gw.decided = true
+	if compress {
+		h := gw.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+	if len(gw.buf) == 0 {
+		return nil
+	}
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(gw.buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(gw.buf)
+	}
+	gw.buf = nil
+	return err
+}
+
+// Flush implements http.Flusher.
+func (gw *gzipWriter) Flush() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the wrapped http.ResponseWriter (used by http.ResponseController).
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// close finishes the response: sends the buffered data if not yet decided,
+// and completes the compressed stream if compressing.
+func (gw *gzipWriter) close() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+	}
+}
+
+// acceptsGzip tells if the client of r accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// compress returns a handler which compresses the responses of next with gzip
+// if s.Gzip is set, the client accepts it, and the response is at least
+// s.GzipMinSize bytes.
+func (s *Server) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Gzip {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, minSize: s.GzipMinSize}
+		next.ServeHTTP(gw, r)
+		gw.close() // Not deferred: if next panics, the response is handled by recoverPanics
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SetCompression enables compressing values at least minSize bytes when storing them,
+// trading CPU for memory (0 disables it). Values are decompressed transparently on read.
+// It must be called before the store is used.
+func (s *Store) SetCompression(minSize int) {
+	s.compressMin = minSize
+}
+
+// deflate compresses value for storing it compressed in memory.
+// ok is false if compressing doesn't make value smaller.
+func deflate(value string) (data string, ok bool) {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed) // Only fails with an invalid level
+	io.WriteString(fw, value)
+	fw.Close()
+	if buf.Len() >= len(value) {
+		return "", false
+	}
+	return buf.String(), true
+}
+
+// inflate decompresses data compressed by deflate.
+// The data is produced by deflate in memory, so it can only be corrupt because of a bug
+// (or memory corruption): ErrCorrupt is returned then.
+func inflate(data string) (string, error) {
+	value, err := io.ReadAll(flate.NewReader(strings.NewReader(data)))
+	if err != nil {
+		return "", fmt.Errorf("%w (%v)", ErrCorrupt, err)
+	}
+	return string(value), nil
+}
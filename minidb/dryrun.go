@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// HeaderDryRun is the header marking responses of dry runs.
+const HeaderDryRun = "Dry-Run"
+
+// Dry runs: mutating requests (PUT, POST, PATCH, DELETE) of /values/ and /reservations/ with
+// a dry_run=true query parameter are validated like the real requests (key, lock id,
+// size limits, lock ownership, expected values), and their response tells what would
+// happen, but the store is not mutated (not even the access counters).
+// Other mutating endpoints reject dry runs, so they are never executed by mistake.
+
+// Probe is the state of a key, as seen by dry runs.
+type Probe struct {
+	Exists bool   // Tells if key exists (and its value is not expired)
+	Locked bool   // Tells if the lock of key is held or waited for
+	Value  string // Value of key
+}
+
+// Probe returns the state of key without touching it: unlike Get, it doesn't count
+// as an access. If check is not nil, it's called with the valueWr of key (nil if it
+// doesn't exist) while its shard is locked, to run the checks of the real operation
+// (e.g. checkUpdatable): its error is returned.
+func (s *Store) Probe(key string, check func(vw *valueWr) error) (p Probe, err error) {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	vw := sh.m[key]
+	if check != nil {
+		if err = check(vw); err != nil {
+			return p, err
+		}
+	}
+	if vw == nil || vw.valueExpired(time.Now()) {
+		return p, nil
+	}
+	value, err := vw.value()
+	if err != nil {
+		return p, err
+	}
+	return Probe{Exists: true, Locked: vw.held || len(vw.waiters) > 0, Value: value}, nil
+}
+
+// parseDryRun parses the dry_run query parameter of mutating requests.
+// If it's invalid, an error response is sent and ok is false.
+func parseDryRun(w http.ResponseWriter, r *http.Request) (dry, ok bool) {
+	switch r.URL.Query().Get("dry_run") {
+	case "", "false":
+		return false, true
+	case "true":
+		return true, true
+	}
+	badRequest(w, "Invalid dry_run parameter (must be 'true' or 'false')!")
+	return false, false
+}
+
+// isMutating tells if method mutates the store.
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// noDryRun returns a handler which rejects dry runs of mutating requests,
+// for endpoints not supporting them.
+func noDryRun(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isMutating(r.Method) {
+			if dry, ok := parseDryRun(w, r); !ok {
+				return
+			} else if dry {
+				rejectDryRun(w)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// rejectDryRun sends an error response for a dry run of an endpoint not supporting it.
+func rejectDryRun(w http.ResponseWriter) {
+	badRequest(w, "Dry run is not supported by this endpoint!")
+}
+
+// sendDryRun sends the outcome of a dry run: resp describes what would happen.
+func sendDryRun(w http.ResponseWriter, resp map[string]interface{}) {
+	resp["dry_run"] = true
+	w.Header().Set(HeaderDryRun, "true")
+	sendJSON(w, resp)
+}
+
+// dryRunLockId returns what a lock id of a successful request would look like.
+// It's random like real ones, but it's never valid.
+func dryRunLockId(w http.ResponseWriter, r *http.Request) (string, bool) {
+	lockId, err := genLockId()
+	if err != nil {
+		sendStoreError(w, r, err)
+		return "", false
+	}
+	return lockId, true
+}
+
+// dryRunReserve handles dry runs of reservations of key
+// (absent tells if the key is reserved only if it doesn't exist).
+func (s *Server) dryRunReserve(w http.ResponseWriter, r *http.Request, key string, p reserveParams, until *string, absent bool) {
+	probe, err := s.store.Probe(key, func(vw *valueWr) error {
+		return checkReservable(vw, absent, p.wait)
+	})
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	lockId, ok := dryRunLockId(w, r)
+	if !ok {
+		return
+	}
+	resp := map[string]interface{}{"lock_id": lockId, "value": probe.Value, "would_wait": probe.Locked}
+	if until != nil && probe.Value != *until {
+		resp["value"], resp["would_wait"] = *until, true
+	}
+	sendDryRun(w, resp)
+}
+
+// dryRunValues handles dry runs of the mutating requests of /values/{key}
+// (parts are the path parts like in valuesHandler): the request is validated, and
+// the response tells what would happen, but the store is not mutated.
+func (s *Server) dryRunValues(w http.ResponseWriter, r *http.Request, key string, parts []string) {
+	switch r.Method {
+	case http.MethodPatch:
+		// PATCH /values/{key}/{lock_id}?release={true, false}&dry_run=true
+		s.patch(w, r, key, parts, true)
+	case http.MethodPost:
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "incr", "append", "copy", "rename":
+				rejectDryRun(w)
+				return
+			}
+		}
+		// POST /values/{key}/{lock_id}?release={true, false}&dry_run=true
+		u, ok := s.parseUpdate(w, r, parts)
+		if !ok {
+			return
+		}
+		_, err := s.store.Probe(key, func(vw *valueWr) error { return checkUpdatable(vw, u.lockId) })
+		if err == nil && !s.store.wouldFit(key, len(u.value)) {
+			err = ErrInsufficientStorage
+		}
+		if err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		sendDryRun(w, map[string]interface{}{"released": u.release})
+	case http.MethodPut:
+		// PUT /values/{key}?expect={value}&ttl={duration}&dry_run=true
+		u, ok := s.parsePut(w, r)
+		if !ok {
+			return
+		}
+		probe, err := s.store.Probe(key, nil)
+		if err == nil && !s.store.wouldFit(key, len(u.value)) {
+			err = ErrInsufficientStorage
+		}
+		if err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		// Conditions are checked against the current value, the real request checks
+		// them once it acquires the lock (if it has to wait, the value may change).
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			if !probe.Exists || !etagMatches(ifMatch, ETag(probe.Value)) {
+				sendStoreError(w, r, ErrPrecondition)
+				return
+			}
+		} else if expect, ok := r.URL.Query()["expect"]; ok {
+			if !probe.Exists {
+				err = ErrNotFound
+			} else if probe.Value != expect[0] {
+				err = ErrMismatch
+			}
+			if err != nil {
+				sendStoreError(w, r, err)
+				return
+			}
+		}
+		lockId, ok := dryRunLockId(w, r)
+		if !ok {
+			return
+		}
+		sendDryRun(w, map[string]interface{}{"lock_id": lockId, "created": !probe.Exists, "would_wait": probe.Locked})
+	case http.MethodDelete:
+		if expect, ok := r.URL.Query()["expect"]; ok && len(parts) == 1 {
+			// DELETE /values/{key}?expect={value}&dry_run=true
+			probe, err := s.store.Probe(key, nil)
+			if err == nil && !probe.Exists {
+				err = ErrNotFound
+			}
+			if err == nil && probe.Value != expect[0] {
+				err = ErrMismatch
+			}
+			if err != nil {
+				sendStoreError(w, r, err)
+				return
+			}
+			sendDryRun(w, map[string]interface{}{"would_wait": probe.Locked})
+			return
+		}
+		// DELETE /values/{key}/{lock_id}?dry_run=true
+		lockId, ok := parseDeleteLockId(w, parts)
+		if !ok {
+			return
+		}
+		if _, err := s.store.Probe(key, func(vw *valueWr) error { return checkLockHeld(vw, lockId) }); err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		sendDryRun(w, map[string]interface{}{})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventHistorySize = 1024             // Default number of recent changes kept for resuming streams and /changes
+	eventSubBuffer   = 256              // Buffer size of subscriber channels
+	eventKeepalive   = 30 * time.Second // Interval of keepalive comments on idle streams
+
+	DefaultChangesLimit = 100 // Default max number of changes returned by /changes
+)
+
+// Headers of /changes responses.
+const (
+	HeaderOldestSeq = "Oldest-Seq" // Sequence number of the oldest kept change
+	HeaderLastSeq   = "Last-Seq"   // Sequence number of the last change
+)
+
+// Event describes a mutation of the store.
+type Event struct {
+	Seq uint64 `json:"seq"` // Sequence number, strictly increasing
+	Op  string `json:"op"`  // Operation, OpPut, OpDelete or OpFlush
+	Key string `json:"key"` // Key being mutated (empty for OpFlush)
+}
+
+// Change is a mutation of the store as returned by /changes: its event and the new value.
+// The history only keeps the events (so it doesn't hold on to values), the value of a put
+// is the current value of the key when the change is returned.
+type Change struct {
+	Event
+	Value       string     `json:"value,omitempty"`        // Current value (OpPut)
+	ContentType string     `json:"content_type,omitempty"` // Content type of the new value (OpPut), if it has one
+	Expires     *time.Time `json:"expires,omitempty"`      // Time when the new value expires (OpPut), nil if it never expires
+}
+
+// eventHub distributes the mutation events of the store to subscribers.
+// It keeps the recent events in a ring buffer, so subscribers can resume from a sequence
+// number, and clients can tail the changes (see changes).
+//
+// Its methods are safe for concurrent use.
+type eventHub struct {
+	mux     sync.Mutex
+	seq     uint64                  // Sequence number of the last event
+	history []Event                 // Ring buffer of the recent events, at most cap(history)
+	start   int                     // Index of the oldest event in history (once it's full)
+	subs    map[chan Event]struct{} // Channels of the subscribers
+}
+
+// newEventHub creates a new eventHub keeping the given number of recent events.
+func newEventHub(historySize int) *eventHub {
+	return &eventHub{
+		history: make([]Event, 0, historySize),
+		subs:    make(map[chan Event]struct{}),
+	}
+}
+
+// each calls f with the kept events having a higher sequence number than after,
+// oldest first, until f returns false. h.mux must be locked.
+func (h *eventHub) each(after uint64, f func(ev Event) bool) {
+	for i := range h.history {
+		ev := h.history[(h.start+i)%len(h.history)]
+		if ev.Seq > after && !f(ev) {
+			return
+		}
+	}
+}
+
+// publish publishes an event of the mutation rec.
+// Subscribers which can't keep up (whose channel is full) are dropped (their channel is closed),
+// they may resubscribe resuming from the last event they received.
+func (h *eventHub) publish(rec walRecord) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.seq++
+	ev := Event{Seq: h.seq, Op: rec.Op, Key: rec.Key}
+	if len(h.history) < cap(h.history) {
+		h.history = append(h.history, ev)
+	} else if len(h.history) > 0 {
+		h.history[h.start] = ev // Overwrite the oldest
+		h.start = (h.start + 1) % len(h.history)
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe subscribes to the events. If after > 0, the kept events with a higher sequence number
+// are returned as backlog (events not kept anymore are lost).
+// The returned channel receives the subsequent events, and is closed if the subscriber
+// can't keep up. unsubscribe must be called when the subscriber is done.
+func (h *eventHub) subscribe(after uint64) (ch chan Event, backlog []Event) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if after > 0 {
+		h.each(after, func(ev Event) bool {
+			backlog = append(backlog, ev)
+			return true
+		})
+	}
+	ch = make(chan Event, eventSubBuffer)
+	h.subs[ch] = struct{}{}
+	return ch, backlog
+}
+
+// changes returns at most limit of the kept events having a higher sequence number than since,
+// oldest first. Also returns the sequence number of the oldest kept event (the next one
+// if none is kept), and of the last event. If since < oldest-1, changes have been lost
+// for a client which has seen the changes up to since.
+func (h *eventHub) changes(since uint64, limit int) (events []Event, oldest, last uint64) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	oldest = h.seq + 1
+	if len(h.history) > 0 {
+		oldest = h.history[h.start].Seq
+	}
+	h.each(since, func(ev Event) bool {
+		if len(events) == limit {
+			return false
+		}
+		events = append(events, ev)
+		return true
+	})
+	return events, oldest, h.seq
+}
+
+// Changes returns the changes of events, the puts with the current values of their keys.
+// Puts of keys which don't exist anymore (deleted or expired since) are returned as deletes,
+// so applying the changes in order still results in the current state.
+func (s *Store) Changes(events []Event) ([]Change, error) {
+	changes := make([]Change, 0, len(events))
+	for _, ev := range events {
+		c := Change{Event: ev}
+		if ev.Op == OpPut {
+			e, ok, err := s.entry(ev.Key)
+			switch {
+			case err != nil:
+				return nil, err
+			case ok:
+				c.Value, c.ContentType, c.Expires = e.Value, e.ContentType, e.Expires
+			default:
+				c.Op = OpDelete
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// entry returns the entry of key, and whether it exists (it's not expired).
+func (s *Store) entry(key string) (e entry, ok bool, err error) {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	vw := sh.m[key]
+	if vw == nil || vw.valueExpired(time.Now()) {
+		return entry{}, false, nil
+	}
+	if e, err = vw.entry(key); err != nil {
+		return entry{}, false, err
+	}
+	return e, true, nil
+}
+
+// unsubscribe unsubscribes the subscriber of ch (if it's not yet dropped).
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler is a request handler which handles the endpoint
+// mapped to /events, streaming the mutation events as server-sent events.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	// GET /events
+	var after uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			badRequest(w, "Invalid Last-Event-ID header (must be a non-negative integer)!")
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream lasts as long as the client wants it, the write timeout must not apply
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Internal server error!")
+		return
+	}
+
+	ch, backlog := s.store.events.subscribe(after)
+	defer s.store.events.unsubscribe(ch)
+	// Streams are mostly idle waiting for events
+	defer beginWait(r.Context())()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, ev := range backlog {
+		writeEvent(w, ev)
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return // Dropped, client has to reconnect
+			}
+			writeEvent(w, ev)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes ev as a server-sent event.
+func writeEvent(w http.ResponseWriter, ev Event) {
+	data, _ := json.Marshal(ev) // Can't fail
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.Seq, data)
+}
+
+// changesHandler is a request handler which handles the endpoint
+// mapped to /changes, returning the recent changes after a sequence number.
+func (s *Server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	// GET /changes?since={seq}&limit={limit}
+	q := r.URL.Query()
+	var since uint64
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			badRequest(w, "Invalid since parameter (must be a non-negative integer)!")
+			return
+		}
+	}
+	limit := DefaultChangesLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > s.MaxBulkKeys {
+			badRequest(w, "Invalid limit parameter (must be a positive integer, at most the max bulk keys)!")
+			return
+		}
+	}
+
+	events, oldest, last := s.store.events.changes(since, limit)
+	w.Header().Set(HeaderOldestSeq, strconv.FormatUint(oldest, 10))
+	w.Header().Set(HeaderLastSeq, strconv.FormatUint(last, 10))
+	if since < oldest-1 { // oldest >= 1
+		writeError(w, http.StatusGone, CodeResyncRequired,
+			fmt.Sprintf("Changes after %d are not kept anymore, oldest kept is %d, resync required!", since, oldest))
+		return
+	}
+	changes, err := s.store.Changes(events)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	sendJSON(w, changes)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Modes of imports.
+const (
+	ImportMerge   = "merge"   // Imported keys are set, other keys are kept
+	ImportReplace = "replace" // All keys are deleted first
+)
+
+// entry is a line of exports and imports (and an entry of snapshots):
+// a key and its value with the content type and expiry of the value.
+type entry struct {
+	Key         string     `json:"key"`
+	Value       string     `json:"value"`
+	ContentType string     `json:"content_type,omitempty"` // Content type of the value, if it has one
+	Expires     *time.Time `json:"expires,omitempty"`      // Time when the value expires, nil if it never expires
+}
+
+// entry returns the entry of key whose value is vw.
+func (vw *valueWr) entry(key string) (entry, error) {
+	value, err := vw.value()
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{Key: key, Value: value, ContentType: vw.ContentType, Expires: timePtr(vw.ValueExpires)}, nil
+}
+
+// exportShard returns the entries of sh (without the expired values).
+// Corrupt values are skipped (and logged), so they don't prevent exporting the rest.
+func exportShard(sh *shard) []entry {
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	now := time.Now()
+	entries := make([]entry, 0, len(sh.m))
+	for key, vw := range sh.m {
+		if vw.valueExpired(now) {
+			continue
+		}
+		e, err := vw.entry(key)
+		if err != nil {
+			log.Printf("Skipping key %q in export: %v", key, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Import sets the keys of entries to their values (with their content types and expiries)
+// atomically, like PutAll but without acquiring locks. If replace is true, all other keys are deleted
+// (releasing their locks). Else it's all-or-nothing: if any of the keys is locked,
+// nothing is set and ErrLocked is returned. If the values don't fit in the memory budget,
+// nothing is set and ErrInsufficientStorage is returned.
+// Returns the number of imported keys.
+func (s *Store) Import(entries map[string]entry, replace bool) (int, error) {
+	values := make(map[string]string, len(entries))
+	for key, e := range entries {
+		values[key] = e.Value
+	}
+	keys := valuesKeys(values)
+	defer s.evict(keys...) // After the shards are unlocked
+	if !replace {
+		s.makeRoom(valuesSize(values), keys...)
+	}
+	s.lockAll()
+	defer s.unlockAll()
+
+	if !s.fitsAll(values, replace) {
+		return 0, ErrInsufficientStorage
+	}
+	if replace {
+		if err := s.logMutation(walRecord{Op: OpFlush}); err != nil {
+			return 0, err
+		}
+		s.clear()
+	} else {
+		for key := range values {
+			if vw := s.shard(key).m[key]; vw != nil && (vw.held || len(vw.waiters) > 0) {
+				return 0, ErrLocked
+			}
+		}
+	}
+
+	for key, e := range entries {
+		rec := walRecord{Op: OpPut, Key: key, Value: e.Value, ContentType: e.ContentType, Expires: e.Expires}
+		if err := s.logMutation(rec); err != nil {
+			return 0, err
+		}
+		sh := s.shard(key)
+		vw := sh.m[key]
+		if vw == nil {
+			vw = newValueWr()
+			sh.m[key] = vw
+		}
+		s.setRecord(vw, rec)
+	}
+	return len(entries), nil
+}
+
+// exportHandler is a request handler which handles the endpoint
+// mapped to /export, streaming all keys and their values as newline-delimited JSON.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	// GET /export
+	// Shards are exported one by one, so neither the whole store is locked,
+	// nor all the values are copied at once.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w) // Encode writes a newline after each entry
+	for _, sh := range s.store.shards {
+		for _, e := range exportShard(sh) {
+			if err := enc.Encode(e); err != nil {
+				return // Client went away
+			}
+		}
+		http.NewResponseController(w).Flush()
+	}
+}
+
+// importHandler is a request handler which handles the endpoint
+// mapped to /import, loading keys and their values from newline-delimited JSON
+// (in the format of /export). It requires the admin token, and the size of the body
+// is limited to s.MaxImportSize.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	// POST /import?mode={merge, replace}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = ImportMerge
+	}
+	if mode != ImportMerge && mode != ImportReplace {
+		badRequest(w, "Invalid mode parameter (must be 'merge' or 'replace')!")
+		return
+	}
+
+	body, ok := s.readBodyMax(w, r, s.MaxImportSize, "Import")
+	if !ok {
+		return
+	}
+
+	entries := make(map[string]entry)
+	dec := json.NewDecoder(strings.NewReader(body))
+	for line := 1; ; line++ {
+		var e entry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			badRequest(w, fmt.Sprintf("Invalid entry %d, must be a JSON object with key and value!", line))
+			return
+		}
+		if err := s.checkStoredKey(e.Key); err != nil {
+			writeError(w, http.StatusBadRequest, keyErrorCode(err), fmt.Sprintf("%v (key: %q)", err, e.Key))
+			return
+		}
+		if int64(len(e.Value)) > s.MaxValueSize {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge,
+				fmt.Sprintf("Value too large, max allowed size is %d bytes (key: %q)!", s.MaxValueSize, e.Key))
+			return
+		}
+		entries[e.Key] = e
+	}
+
+	n, err := s.store.Import(entries, mode == ImportReplace)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	sendJSON(w, map[string]int{"imported": n})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// importAs posts body to the import endpoint target with the admin token.
+func importAs(h http.Handler, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestExportImport(t *testing.T) {
+	values := map[string]string{"a": "1", "empty": "", "unicode": "héllo, 世界", "multi": "line\nbreak"}
+	s := newTestServer()
+	for key, value := range values {
+		put(t, s, key, value)
+	}
+	w := do(s, http.MethodGet, PathExport, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Export: got status %d", w.Code)
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != len(values) {
+		t.Errorf("Export: got %d lines, want %d", lines, len(values))
+	}
+	export := w.Body.String()
+
+	s = newTestServer()
+	s.AdminToken = "secret"
+	w = importAs(s, PathImport, "secret", export)
+	var resp struct {
+		Imported int `json:"imported"`
+	}
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Imported != len(values) {
+		t.Errorf("Import: got status %d, %d imported, want %d", w.Code, resp.Imported, len(values))
+	}
+	for key, want := range values {
+		if value, err := s.store.Get(key); err != nil || value != want {
+			t.Errorf("Got value %q (%v) for %s, want %q", value, err, key, want)
+		}
+	}
+}
+
+func TestImportModes(t *testing.T) {
+	s := newTestServer()
+	s.AdminToken = "secret"
+	if err := s.store.Release("x", put(t, s, "x", "old")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := importAs(s, PathImport+"?mode=merge", "secret", `{"key":"a","value":"1"}`); w.Code != http.StatusOK {
+		t.Errorf("Merge: got status %d", w.Code)
+	}
+	if _, err := s.store.Get("x"); err != nil {
+		t.Errorf("Merge: existing key is gone: %v", err)
+	}
+
+	if w := importAs(s, PathImport+"?mode=replace", "secret", `{"key":"b","value":"2"}`); w.Code != http.StatusOK {
+		t.Errorf("Replace: got status %d", w.Code)
+	}
+	for key, want := range map[string]bool{"a": false, "x": false, "b": true} {
+		if _, err := s.store.Get(key); (err == nil) != want {
+			t.Errorf("Replace: key %s present: %t, want %t", key, err == nil, want)
+		}
+	}
+
+	// Invalid entries fail the whole import.
+	body := `{"key":"c","value":"3"}` + "\n" + `{"key":"","value":"4"}`
+	if w := importAs(s, PathImport, "secret", body); w.Code != http.StatusBadRequest {
+		t.Errorf("Missing key: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := importAs(s, PathImport, "secret", `not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid entry: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := importAs(s, PathImport+"?mode=other", "secret", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid mode: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if _, err := s.store.Get("c"); err != ErrNotFound {
+		t.Errorf("Got error %v for key of failed import, want %v", err, ErrNotFound)
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	s := newTestServer()
+	s.AdminToken = "secret"
+	body := `{"key":"a","value":"1"}`
+	for _, token := range []string{"", "wrong"} {
+		if w := importAs(s, PathImport+"?mode=replace", token, body); w.Code != http.StatusUnauthorized {
+			t.Errorf("Token %q: got status %d, want %d", token, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	s.MaxImportSize = int64(len(body)) - 1
+	if w := importAs(s, PathImport, "secret", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Too large: got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if _, err := s.store.Get("a"); err != ErrNotFound {
+		t.Errorf("Got error %v for a, want nothing imported", err)
+	}
+}
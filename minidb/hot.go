@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultHotKeys is the default number of keys returned by /stats/hot.
+const DefaultHotKeys = 10
+
+// HotKey is a key and its number of accesses.
+type HotKey struct {
+	Key      string `json:"key"`
+	Accesses uint64 `json:"accesses"` // Number of reads, writes and reservations
+}
+
+// HotKeys returns the n most accessed keys, most accessed first.
+// Only n keys are kept in memory at a time, so it scales to large stores.
+func (s *Store) HotKeys(n int) []HotKey {
+	top := newTopN(n, func(a, b interface{}) bool { return a.(HotKey).Accesses < b.(HotKey).Accesses })
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		for key, vw := range sh.m {
+			top.offer(HotKey{Key: key, Accesses: atomic.LoadUint64(&vw.Accesses)})
+		}
+		sh.mux.RUnlock()
+	}
+	hot := make([]HotKey, 0, top.Len())
+	for _, x := range top.sorted() {
+		hot = append(hot, x.(HotKey))
+	}
+	return hot
+}
+
+// statsHotHandler is a request handler which handles the endpoint
+// mapped to /stats/hot, returning the most accessed keys.
+func (s *Server) statsHotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	// GET /stats/hot?n={n}
+	n := DefaultHotKeys
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 || n > s.MaxBulkKeys {
+			badRequest(w, "Invalid n parameter (must be a positive integer, at most the max bulk keys)!")
+			return
+		}
+	}
+
+	sendJSON(w, s.store.HotKeys(n))
+}
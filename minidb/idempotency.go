@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HeaderIdempotencyKey is the header of idempotency keys.
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// idemEntry is a response recorded for an idempotency key.
+type idemEntry struct {
+	key     string            // Cache key: method, client, request URI and idempotency key
+	bodySum [sha256.Size]byte // Hash of the request body
+	done    chan struct{}     // Closed when the response is recorded
+	ok      bool              // Tells if the response is recorded (else it must not be replayed)
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time // Time when the entry expires
+}
+
+// IdempotencyCache records the responses of mutating requests carrying an
+// Idempotency-Key header, so retries of them are answered with the recorded
+// response instead of being executed again.
+// It keeps at most maxKeys responses, each for ttl; the least recently used
+// ones are dropped over the limit.
+//
+// Its methods are safe for concurrent use.
+type IdempotencyCache struct {
+	ttl     time.Duration
+	maxKeys int
+
+	mux     sync.Mutex
+	order   *list.List               // Entries, most recently used first
+	entries map[string]*list.Element // Elements of order by cache key
+}
+
+// NewIdempotencyCache creates a new IdempotencyCache keeping at most maxKeys
+// responses, each for ttl.
+func NewIdempotencyCache(ttl time.Duration, maxKeys int) *IdempotencyCache {
+	return &IdempotencyCache{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// begin returns the entry of key. If there is no (unexpired) entry, a new
+// one is created (recording bodySum) and first is true: the caller must execute
+// the request and call finish with the entry. Else the caller must wait for the
+// entry to be done.
+func (c *IdempotencyCache) begin(key string, bodySum [sha256.Size]byte) (e *idemEntry, first bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if el := c.entries[key]; el != nil {
+		e = el.Value.(*idemEntry)
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			c.order.MoveToFront(el)
+			return e, false
+		}
+		c.order.Remove(el) // Expired
+	}
+	e = &idemEntry{key: key, bodySum: bodySum, done: make(chan struct{})}
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.maxKeys {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*idemEntry).key)
+	}
+	return e, true
+}
+
+// finish records the response of e (if ok), and wakes those waiting for it.
+// If not ok, the entry is removed, so the request may be retried.
+func (c *IdempotencyCache) finish(e *idemEntry, ok bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e.ok = ok
+	e.expires = time.Now().Add(c.ttl)
+	if !ok {
+		if el := c.entries[e.key]; el != nil && el.Value == e {
+			c.order.Remove(el)
+			delete(c.entries, e.key)
+		}
+	}
+	close(e.done)
+}
+
+// recorder is an http.ResponseWriter which records the response written to it
+// (besides writing it to the wrapped writer).
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter (used by http.ResponseController).
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// replayHeader returns a copy of the response header h to be replayed.
+// Headers describing the encoding of the sent body are dropped: the recorded body is
+// the one written by the handler, the encoding (if any) is applied again on replay.
+func replayHeader(h http.Header) http.Header {
+	h = h.Clone()
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	h.Del("Vary")
+	return h
+}
+
+// idempotent returns a handler which makes the PUT and POST requests of next carrying
+// an Idempotency-Key header idempotent using s.Idempotency (if set): the response of
+// the first request is recorded, and replayed to later requests of the same client
+// (basic auth user, else X-Owner) with the same method, request URI (path and query) and
+// idempotency key (with an "Idempotent-Replayed: true" header).
+// Requests arriving while the first one is being served wait for its response.
+// Reusing the idempotency key with a different body is rejected with 422 Unprocessable Entity.
+// Responses of failures which are worth retrying (5xx, 408, 429) are not recorded.
+// Bodies over the size accepted by the endpoint are not made idempotent (they are rejected anyway).
+func (s *Server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idemKey := r.Header.Get(HeaderIdempotencyKey)
+		if s.Idempotency == nil || idemKey == "" || (r.Method != http.MethodPut && r.Method != http.MethodPost) ||
+			r.URL.Query().Get("dry_run") == "true" { // Dry runs must not be replayed to the real request
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Read the body to hash it (as sent, before decompression).
+		max := s.MaxValueSize
+		if r.URL.Path == PathImport {
+			max = s.MaxImportSize
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+		if err != nil {
+			badRequest(w, "Failed to read body!")
+			return
+		}
+		if int64(len(body)) > max {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		bodySum := sha256.Sum256(body)
+
+		client, _, ok := r.BasicAuth()
+		if !ok {
+			client = r.Header.Get(HeaderOwner)
+		}
+		key := fmt.Sprintf("%s %q %s %s", r.Method, client, r.URL.RequestURI(), idemKey)
+		for {
+			e, first := s.Idempotency.begin(key, bodySum)
+			if first {
+				rec := &recorder{ResponseWriter: w}
+				ok := false
+				defer func() { s.Idempotency.finish(e, ok) }() // Also if next panics
+				next.ServeHTTP(rec, r)
+				if rec.status != 0 && rec.status < 500 &&
+					rec.status != http.StatusRequestTimeout && rec.status != http.StatusTooManyRequests {
+					e.status, e.header, e.body = rec.status, replayHeader(w.Header()), rec.body.Bytes()
+					ok = true
+				}
+				return
+			}
+
+			if e.bodySum != bodySum {
+				writeError(w, http.StatusUnprocessableEntity, CodeIdempotencyMismatch,
+					fmt.Sprintf("%s is already used with a different request body!", HeaderIdempotencyKey))
+				return
+			}
+
+			endWait := beginWait(r.Context())
+			select {
+			case <-e.done:
+				endWait()
+			case <-r.Context().Done():
+				endWait()
+				return
+			}
+			if !e.ok {
+				continue // First one failed, execute this one
+			}
+			h := w.Header()
+			for k, v := range e.header {
+				if k != http.CanonicalHeaderKey(HeaderRequestID) { // This request has its own
+					h[k] = v
+				}
+			}
+			h.Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Styles of the field names of JSON responses.
+const (
+	JSONStyleSnake = "snake" // snake_case, e.g. "lock_id" (default)
+	JSONStyleCamel = "camel" // camelCase, e.g. "lockId"
+)
+
+// jsonStyle is the style of the field names of JSON responses.
+var jsonStyle = JSONStyleSnake
+
+// SetJSONStyle sets the style of the field names of JSON responses (JSONStyleSnake or
+// JSONStyleCamel). Only field names are affected: keys of the store appearing as object keys
+// (e.g. in bulk responses) are sent as is.
+// It must be called before any response is sent.
+func SetJSONStyle(style string) error {
+	if style != JSONStyleSnake && style != JSONStyleCamel {
+		return fmt.Errorf("invalid JSON style: %q", style)
+	}
+	jsonStyle = style
+	return nil
+}
+
+// camelCase converts the snake_case name to camelCase.
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// jsonMarshalerType is the type of json.Marshaler.
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// camelJSON returns v with the field names converted to camelCase, to be encoded
+// as JSON in its place. Field names are the (JSON) names of struct fields, and the keys of
+// map[string]interface{} values, which are used for the ad hoc objects of responses.
+// Keys of other maps (e.g. map[string]string) are data (keys of the store), they are kept.
+// Values encoding themselves (json.Marshaler, e.g. time.Time) are kept as is.
+func camelJSON(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) {
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return camelJSON(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		camelFields(v, m)
+		return m
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		renameKeys := v.Type().Key().Kind() == reflect.String && v.Type().Elem().Kind() == reflect.Interface
+		m := make(map[string]interface{}, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			key := fmt.Sprint(it.Key().Interface())
+			if renameKeys {
+				key = camelCase(key)
+			}
+			m[key] = camelJSON(it.Value())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = camelJSON(v.Index(i))
+		}
+		return s
+	}
+	return v.Interface()
+}
+
+// camelFields adds the fields of the struct v to m (as encoding/json would encode them)
+// with their names converted to camelCase. Fields of embedded structs are added as if
+// they were fields of v.
+func camelFields(v reflect.Value, m map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+		if f.Anonymous && name == "" && fv.Kind() == reflect.Struct {
+			camelFields(fv, m)
+			continue
+		}
+		if strings.Contains(opts, "omitempty") && emptyJSON(fv) {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		m[camelCase(name)] = camelJSON(fv)
+	}
+}
+
+// emptyJSON tells if v is empty in terms of the omitempty option of encoding/json.
+func emptyJSON(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultLocksLimit is the default max number of locks returned by /admin/locks.
+const DefaultLocksLimit = 100
+
+// LockInfo describes a currently held lock.
+type LockInfo struct {
+	Key      string    `json:"key"`                   // Key of the lock
+	LockedAt time.Time `json:"locked_at"`             // Time when the lock was acquired
+	TTL      float64   `json:"ttl_seconds,omitempty"` // Remaining time of the lock in seconds (if it has a TTL)
+	Owner    string    `json:"owner,omitempty"`       // Owner of the lock (if its holder told it)
+	Waiters  int       `json:"waiters"`               // Number of waiters for the lock
+}
+
+// Locks returns the currently held locks, at most limit of them: the ones held
+// for the longest, longest first. Only limit locks are kept in memory at a time.
+// Shards are locked (for reading) one at a time, so writers are not stalled
+// for the whole snapshot, but it's not an atomic snapshot of all the locks.
+func (s *Store) Locks(limit int) []LockInfo {
+	top := newTopN(limit, func(a, b interface{}) bool { return a.(LockInfo).LockedAt.After(b.(LockInfo).LockedAt) })
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		for key, vw := range sh.m {
+			if vw.LockId == "" {
+				continue
+			}
+			l := LockInfo{Key: key, LockedAt: vw.LockedAt}
+			if !top.accepts(l) {
+				continue // Not older than the kept ones
+			}
+			l.Owner, l.Waiters = vw.Owner, len(vw.waiters)
+			if !vw.Expires.IsZero() {
+				l.TTL = time.Until(vw.Expires).Seconds()
+			}
+			top.offer(l)
+		}
+		sh.mux.RUnlock()
+	}
+	locks := make([]LockInfo, 0, top.Len())
+	for _, x := range top.sorted() {
+		locks = append(locks, x.(LockInfo))
+	}
+	return locks
+}
+
+// adminLocksHandler is a request handler which handles the endpoint
+// mapped to /admin/locks, listing the currently held locks.
+func (s *Server) adminLocksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	// GET /admin/locks?limit={limit}
+	limit := DefaultLocksLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > s.MaxBulkKeys {
+			badRequest(w, "Invalid limit parameter (must be a positive integer, at most the max bulk keys)!")
+			return
+		}
+	}
+
+	sendJSON(w, s.store.Locks(limit))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// lru tracks the access order of the keys of the store, so the least recently used
+// keys can be evicted when the store has more keys than allowed.
+//
+// Its methods are safe for concurrent use. If both are needed, the shard
+// mutex must be locked before lru.mux.
+type lru struct {
+	mux   sync.Mutex
+	order *list.List               // Keys, most recently used first
+	elems map[string]*list.Element // Elements of order by key
+}
+
+// newLRU creates a new lru.
+func newLRU() *lru {
+	return &lru{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+// touch marks key as the most recently used one.
+func (c *lru) touch(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if e := c.elems[key]; e != nil {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.elems[key] = c.order.PushFront(key)
+}
+
+// remove removes key.
+func (c *lru) remove(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if e := c.elems[key]; e != nil {
+		c.order.Remove(e)
+		delete(c.elems, key)
+	}
+}
+
+// reset removes all keys.
+func (c *lru) reset() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.order.Init()
+	c.elems = make(map[string]*list.Element)
+}
+
+// len returns the number of keys.
+func (c *lru) len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.order.Len()
+}
+
+// oldest returns the n least recently used keys, least recent first.
+func (c *lru) oldest(n int) []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	keys := make([]string, 0, n)
+	for e := c.order.Back(); e != nil && len(keys) < n; e = e.Prev() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
+
+// EnableLRU limits the number of keys to maxKeys: when a write creates keys over the limit,
+// the least recently used (read or written) keys are evicted. Locked keys (and keys being
+// waited for) are never evicted, so the store may exceed the limit if most keys are locked.
+// It must be called before the store is used.
+func (s *Store) EnableLRU(maxKeys int) {
+	s.lru = newLRU()
+	s.maxKeys = maxKeys
+}
+
+// touch marks key as recently used if LRU eviction is enabled.
+func (s *Store) touch(key string) {
+	if s.lru != nil {
+		s.lru.touch(key)
+	}
+}
+
+// trackMutation updates the access order by the mutation described by rec
+// if LRU eviction is enabled.
+func (s *Store) trackMutation(rec walRecord) {
+	if s.lru == nil {
+		return
+	}
+	switch rec.Op {
+	case OpPut:
+		s.lru.touch(rec.Key)
+	case OpDelete:
+		s.lru.remove(rec.Key)
+	case OpFlush:
+		s.lru.reset()
+	}
+}
+
+// evict evicts the least recently used unlocked keys while the store has more keys
+// than allowed. The keys just written are never evicted (their writes would be lost).
+// No shard may be locked by the caller.
+func (s *Store) evict(written ...string) {
+	if s.maxKeys == 0 {
+		return // Only the memory budget is limited (see makeRoom)
+	}
+	skip := make(map[string]bool, len(written))
+	for _, key := range written {
+		skip[key] = true
+	}
+	n := 0 // Number of candidates to check
+	for {
+		excess := s.lru.len() - s.maxKeys
+		if excess <= 0 {
+			return
+		}
+		// Check some more candidates than needed, some may be locked
+		if n < 2*excess {
+			n = 2 * excess
+		}
+		keys := s.lru.oldest(n)
+		for _, key := range keys {
+			if !skip[key] && s.evictKey(key) {
+				if excess--; excess == 0 {
+					break
+				}
+			}
+		}
+		if excess > 0 {
+			if len(keys) < n {
+				return // Checked all keys, the rest is locked
+			}
+			n *= 2 // Too many locked candidates, check more
+		}
+	}
+}
+
+// evictKey deletes key if it is not locked (nor waited for).
+// Returns true if key is gone (it was evicted or it didn't exist anymore).
+func (s *Store) evictKey(key string) bool {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw := sh.m[key]
+	if vw == nil {
+		s.lru.remove(key) // Stale
+		return true
+	}
+	if vw.held || len(vw.waiters) > 0 {
+		return false
+	}
+	if err := s.logMutation(walRecord{Op: OpDelete, Key: key}); err != nil {
+		return false
+	}
+	delete(sh.m, key)
+	s.dropValue(vw)
+	vw.notify()
+	atomic.AddUint64(&s.evictions, 1)
+	return true
+}
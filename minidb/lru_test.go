@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLRUEviction(t *testing.T) {
+	s := newTestServer()
+	s.store.EnableLRU(3)
+	putReleased := func(key string) {
+		t.Helper()
+		if err := s.store.Release(key, put(t, s, key, "v")); err != nil {
+			t.Fatalf("Release %s: %v", key, err)
+		}
+	}
+
+	put(t, s, "a", "v") // Least recently used, but stays locked
+	putReleased("b")
+	putReleased("c")
+	if w := do(s, http.MethodGet, PathValues+"b", ""); w.Code != http.StatusOK {
+		t.Fatalf("GET b: got status %d", w.Code)
+	}
+	putReleased("d") // Evicts c: a is locked, b was read after c
+	putReleased("e") // Evicts b
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": false, "d": true, "e": true} {
+		if _, err := s.store.Get(key); (err == nil) != want {
+			t.Errorf("Key %s present: %t, want %t", key, err == nil, want)
+		}
+	}
+	w := do(s, http.MethodGet, PathMetrics, "")
+	if !strings.Contains(w.Body.String(), "minidb_evictions_total 2\n") {
+		t.Errorf("Eviction counter is not 2 in metrics:\n%s", w.Body)
+	}
+}
+
+func TestLRUEvictionWritten(t *testing.T) {
+	s := newTestServer()
+	s.store.EnableLRU(1)
+	put(t, s, "a", "v") // Locked
+
+	// The new key is the only unlocked one, but it's not evicted right after written.
+	if w := do(s, http.MethodPost, PathValues+"n/incr", ""); w.Code != http.StatusOK {
+		t.Fatalf("Incr: got status %d", w.Code)
+	}
+	if value, err := s.store.Get("n"); err != nil || value != "1" {
+		t.Errorf("Got value %q (%v) for n, want %q", value, err, "1")
+	}
+}
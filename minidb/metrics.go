@@ -0,0 +1,178 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// waitBuckets are the upper bounds of the buckets of the reservation wait histogram, in seconds.
+var waitBuckets = []float64{0.001, 0.01, 0.1, 1, 10, 60, 600}
+
+// requestKey is the label set of the request counter.
+type requestKey struct {
+	method string
+	code   int
+}
+
+// metrics collects the metrics of a Server, exposed in the Prometheus text format.
+// Its methods are safe for concurrent use.
+type metrics struct {
+	mux sync.Mutex
+
+	requests map[requestKey]uint64 // Number of served requests by method and status code
+
+	waitCounts []uint64 // Number of reservation waits by bucket (not cumulative), last is +Inf
+	waitCount  uint64   // Total number of reservation waits
+	waitSum    float64  // Total reservation wait time in seconds
+}
+
+// newMetrics creates a new metrics.
+func newMetrics() *metrics {
+	return &metrics{
+		requests:   make(map[requestKey]uint64),
+		waitCounts: make([]uint64, len(waitBuckets)+1),
+	}
+}
+
+// observeRequest records a served request.
+func (m *metrics) observeRequest(method string, code int) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "OTHER" // Don't let arbitrary methods blow up the number of series
+	}
+
+	m.mux.Lock()
+	m.requests[requestKey{method, code}]++
+	m.mux.Unlock()
+}
+
+// observeWait records the duration a reservation waited for a lock.
+func (m *metrics) observeWait(d time.Duration) {
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(waitBuckets, secs) // Index of first bucket with upper bound >= secs
+
+	m.mux.Lock()
+	m.waitCounts[i]++
+	m.waitCount++
+	m.waitSum += secs
+	m.mux.Unlock()
+}
+
+// write writes the metrics in the Prometheus text format.
+// stats is used for the gauges describing the store.
+func (m *metrics) write(w io.Writer, stats Stats) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	fmt.Fprintln(w, "# HELP minidb_http_requests_total Total number of served HTTP requests.")
+	fmt.Fprintln(w, "# TYPE minidb_http_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "minidb_http_requests_total{method=%q,code=\"%d\"} %d\n", k.method, k.code, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP minidb_locks_held Number of currently held locks.")
+	fmt.Fprintln(w, "# TYPE minidb_locks_held gauge")
+	fmt.Fprintln(w, "minidb_locks_held", stats.LockedKeys)
+
+	fmt.Fprintln(w, "# HELP minidb_keys Number of keys in the store.")
+	fmt.Fprintln(w, "# TYPE minidb_keys gauge")
+	fmt.Fprintln(w, "minidb_keys", stats.Keys)
+
+	fmt.Fprintln(w, "# HELP minidb_lock_waiting Number of goroutines currently waiting for locks.")
+	fmt.Fprintln(w, "# TYPE minidb_lock_waiting gauge")
+	fmt.Fprintln(w, "minidb_lock_waiting", stats.LockWaiting)
+
+	fmt.Fprintln(w, "# HELP minidb_evictions_total Total number of keys evicted by LRU eviction.")
+	fmt.Fprintln(w, "# TYPE minidb_evictions_total counter")
+	fmt.Fprintln(w, "minidb_evictions_total", stats.Evictions)
+
+	fmt.Fprintln(w, "# HELP minidb_reservation_wait_seconds Time reservations waited for the lock.")
+	fmt.Fprintln(w, "# TYPE minidb_reservation_wait_seconds histogram")
+	var cum uint64
+	for i, le := range waitBuckets {
+		cum += m.waitCounts[i]
+		fmt.Fprintf(w, "minidb_reservation_wait_seconds_bucket{le=\"%g\"} %d\n", le, cum)
+	}
+	fmt.Fprintf(w, "minidb_reservation_wait_seconds_bucket{le=\"+Inf\"} %d\n", m.waitCount)
+	fmt.Fprintf(w, "minidb_reservation_wait_seconds_sum %g\n", m.waitSum)
+	fmt.Fprintf(w, "minidb_reservation_wait_seconds_count %d\n", m.waitCount)
+}
+
+// statusWriter is an http.ResponseWriter which captures the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int // Status code of the response, 0 if not yet written
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter (used by http.ResponseController).
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Status returns the status code of the response.
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK // Nothing written means an empty 200 response
+	}
+	return sw.status
+}
+
+// debugVars are the counters of a Server published via expvar (if enabled).
+// The counters are updated atomically.
+type debugVars struct {
+	puts                expvar.Int // Number of successful PUT requests
+	reservations        expvar.Int // Number of granted reservations
+	reservationTimeouts expvar.Int // Number of reservations timed out waiting for the lock
+}
+
+// publishDebugVars publishes the debug vars of s (and the gauges of its store) via expvar
+// under the name "minidb". Since expvar is global, only the first published server is exposed.
+func (s *Server) publishDebugVars() {
+	if expvar.Get("minidb") != nil {
+		return
+	}
+	expvar.Publish("minidb", expvar.Func(func() interface{} {
+		stats := s.store.Stats()
+		return map[string]interface{}{
+			"puts":                 s.vars.puts.Value(),
+			"reservations":         s.vars.reservations.Value(),
+			"reservation_timeouts": s.vars.reservationTimeouts.Value(),
+			"locked_keys":          stats.LockedKeys,
+			"keys":                 stats.Keys,
+			"value_bytes":          stats.ValueBytes,
+		}
+	}))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of the request log.
+const (
+	LogFormatText = "text" // Plain text lines written with the log package
+	LogFormatJSON = "json" // JSON lines written to the standard output
+)
+
+const (
+	HeaderRequestID = "X-Request-ID" // Header of request IDs
+	requestIDLength = 8              // Length of generated request IDs (in bytes, will be double when encoded to hex)
+	maxRequestIDLen = 128            // Max length of request IDs accepted from clients
+)
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request of ctx, or an empty string if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID tells if id (received from a client) is acceptable as a request ID:
+// not too long, and consists of printable ASCII characters (so it can't mess up logs).
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID returns a handler which assigns an ID to the requests of next, for tracing:
+// the X-Request-ID header of the request if present (and valid), else a generated one.
+// The ID is stored in the request context (see RequestID), and echoed in the X-Request-ID
+// response header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			buf, err := randomBytes(requestIDLength)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, CodeInternal, "Internal server error!")
+				return
+			}
+			id = hex.EncodeToString(buf)
+		}
+		w.Header().Set(HeaderRequestID, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestLogEntry is an entry of the request log in JSON format.
+type requestLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Duration  float64   `json:"duration_ms"` // Duration of serving the request in milliseconds
+}
+
+// logRequests returns a handler which logs the requests served by next in the given
+// format (LogFormatText or LogFormatJSON): their method, URL path, response status
+// code, duration and request ID (if any, see withRequestID).
+func logRequests(next http.Handler, format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		d := time.Since(start)
+
+		id := RequestID(r.Context())
+		if format != LogFormatJSON {
+			if id != "" {
+				log.Printf("%s %s %d %v [%s]", r.Method, r.URL.Path, sw.Status(), d, id)
+			} else {
+				log.Printf("%s %s %d %v", r.Method, r.URL.Path, sw.Status(), d)
+			}
+			return
+		}
+		data, err := json.Marshal(requestLogEntry{
+			Time:      start,
+			RequestID: id,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    sw.Status(),
+			Duration:  float64(d) / float64(time.Millisecond),
+		})
+		if err != nil {
+			log.Println("Failed to encode request log entry:", err)
+			return
+		}
+		// A single write, so concurrent entries don't interleave
+		os.Stdout.Write(append(data, '\n'))
+	})
+}
+
+// logSlowRequests returns a handler which logs the requests served by next taking longer
+// than threshold (if positive) as warnings: their method, URL path, key (if any), duration
+// and request ID (if any). Requests which spent time waiting (for locks or changes, see
+// WithWaitHook) are flagged as "waiting" with the time spent waiting, unless they took longer
+// than threshold even without it, so waits are not mistaken for slowness of the server.
+func logSlowRequests(next http.Handler, threshold time.Duration) http.Handler {
+	if threshold <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// The hook is called by the goroutine serving the request, no need to synchronize
+		var waited time.Duration
+		var waitStart time.Time
+		waiting := func(waiting bool) {
+			if waiting {
+				waitStart = time.Now()
+			} else {
+				waited += time.Since(waitStart)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(WithWaitHook(r.Context(), waiting)))
+		d := time.Since(start)
+		if d <= threshold {
+			return
+		}
+
+		kind := "Slow request"
+		if waited > 0 && d-waited <= threshold {
+			kind = "Slow request (waiting)"
+		}
+		log.Printf("WARN: %s: %s %s key=%q took %v (waited %v) [%s]", kind, r.Method, r.URL.Path, keyOf(r), d, waited, RequestID(r.Context()))
+	})
+}
+
+// recoverPanics returns a handler which recovers panics of next: it logs the panic
+// with the stack trace, and sends a 500 Internal Server Error JSON response if nothing
+// has been written to the response yet (else the response can't be fixed anymore).
+// http.ErrAbortHandler panics are passed on, as they are meant to abort the response.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("Panic serving %s %s [%s]: %v\n%s", r.Method, r.URL.Path, RequestID(r.Context()), p, debug.Stack())
+			if sw.status == 0 {
+				writeError(sw, http.StatusInternalServerError, CodeInternal, "Internal server error!")
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// basicAuth returns a handler which requires the s.BasicAuth credentials
+// from the clients of next (if s.BasicAuth is set), responding with
+// 401 Unauthorized to requests without matching credentials.
+// Admin endpoints are exempt, they are authenticated by the admin token.
+func (s *Server) basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.BasicAuth == "" || strings.HasPrefix(r.URL.Path, PathAdmin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wantUser, wantPass, _ := strings.Cut(s.BasicAuth, ":")
+		user, pass, ok := r.BasicAuth()
+		// Compare both even if user doesn't match, so timing doesn't tell which one is wrong
+		userOk := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+		if !ok || !userOk || !passOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="minidb"`)
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid credentials!")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectWrites returns a handler which rejects the mutating requests of next with
+// 503 Service Unavailable while s is read-only (see SetReadOnly).
+// Requests which don't change values are let through: bulk gets, and releases of locks
+// (so locks can't get stuck during maintenance).
+func (s *Server) rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ReadOnly() || !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == PathBulkGet,
+			r.Method == http.MethodDelete && r.URL.Path == PathMultiReserve,
+			r.Method == http.MethodPost && r.URL.Path == PathReleaseEach,
+			r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, PathAdminUnlock),
+			r.Method == http.MethodPost && r.URL.Path == PathReadOnly: // Else it couldn't be turned off
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeError(w, http.StatusServiceUnavailable, CodeReadOnly, "Server is in read-only mode, writes are rejected!")
+	})
+}
+
+// limitInFlight returns a handler which limits the number of requests actively processed
+// by next to s.MaxInFlight (if positive), responding with 503 Service Unavailable to requests
+// over the limit instead of queueing them.
+// Requests waiting in the store (e.g. for the lock of a key, or for changes) don't count
+// against the limit while waiting. The health and readiness checks are not limited.
+func (s *Server) limitInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.MaxInFlight <= 0 || r.URL.Path == PathHealthz || r.URL.Path == PathReadyz {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if atomic.AddInt64(&s.active, 1) > int64(s.MaxInFlight) {
+			atomic.AddInt64(&s.active, -1)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, CodeOverloaded, "Server is overloaded!")
+			return
+		}
+		// When done waiting, the request is resumed even if that exceeds the limit,
+		// it has been admitted already.
+		waiting := func(waiting bool) {
+			if waiting {
+				atomic.AddInt64(&s.active, -1)
+			} else {
+				atomic.AddInt64(&s.active, 1)
+			}
+		}
+		defer atomic.AddInt64(&s.active, -1)
+		next.ServeHTTP(w, r.WithContext(WithWaitHook(r.Context(), waiting)))
+	})
+}
+
+// cors returns a handler which adds the CORS headers to the responses of next
+// for requests from the origins in s.CORSOrigins ("*" allows any origin),
+// and responds to CORS preflight requests with 204 No Content.
+// If s.CORSOrigins is empty, no CORS headers are added.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(s.CORSOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		allowed := false
+		for _, o := range s.CORSOrigins {
+			if o == "*" || o == origin {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if s.BasicAuth != "" {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			// Preflight request
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Content-Encoding, Last-Event-ID, If-Match, If-None-Match, X-Request-ID, Idempotency-Key, X-Owner")
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", "Retry-After, ETag, Location, X-Request-ID, Oldest-Seq, Last-Seq, Dry-Run")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	s := newTestServer()
+	s.mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	s.mux.HandleFunc("/panic-after-write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("boom")
+	})
+
+	w := do(s, http.MethodGet, "/panic", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if code := errorCode(t, w); code != CodeInternal {
+		t.Errorf("Got code %q, want %q", code, CodeInternal)
+	}
+
+	// The response can't be replaced once started.
+	if w := do(s, http.MethodGet, "/panic-after-write", ""); w.Code != http.StatusAccepted {
+		t.Errorf("After write: got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+}
+
+func TestLimitInFlight(t *testing.T) {
+	s := newTestServer()
+	s.MaxInFlight = 1
+	started, unblock := make(chan struct{}), make(chan struct{})
+	s.mux.HandleFunc("/block", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-unblock
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do(s, http.MethodGet, "/block", "")
+	}()
+	<-started
+	w := do(s, http.MethodGet, PathValues+"a", "")
+	close(unblock)
+	<-done
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Missing Retry-After header")
+	}
+	if w := do(s, http.MethodGet, PathHealthz, ""); w.Code != http.StatusOK {
+		t.Errorf("Health check: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestLimitInFlightWaiting(t *testing.T) {
+	s := newTestServer()
+	s.MaxInFlight = 1
+	lockId := put(t, s, "a", "1")
+
+	// A reservation waiting for the lock doesn't count against the limit.
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- do(s, http.MethodPost, PathReservations+"a", "") }()
+	waitUntil(t, func() bool { return waiters(s.store, "a") == 1 })
+	if w := do(s, http.MethodGet, PathValues+"a", ""); w.Code != http.StatusOK {
+		t.Errorf("Got status %d while a reservation is waiting, want %d", w.Code, http.StatusOK)
+	}
+
+	if err := s.store.Release("a", lockId); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("Reservation: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s := newTestServer()
+	s.AdminToken = "secret"
+	lockId := put(t, s, "a", "1")
+	s.SetReadOnly(true)
+
+	writes := []struct{ method, target string }{
+		{http.MethodPut, PathValues + "b"},
+		{http.MethodPost, PathValues + "a/" + lockId + "?release=false"},
+		{http.MethodPatch, PathValues + "a/" + lockId},
+		{http.MethodDelete, PathValues + "a/" + lockId},
+		{http.MethodPost, PathReservations + "a?wait=false"},
+		{http.MethodPut, PathBulk},
+	}
+	for _, c := range writes {
+		w := do(s, c.method, c.target, "2")
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.target, w.Code, http.StatusServiceUnavailable)
+			continue
+		}
+		if code := errorCode(t, w); code != CodeReadOnly {
+			t.Errorf("%s %s: got code %q, want %q", c.method, c.target, code, CodeReadOnly)
+		}
+	}
+	if value, _ := s.store.Get("a"); value != "1" {
+		t.Errorf("Got value %q, want unchanged %q", value, "1")
+	}
+
+	reads := []struct{ method, target, body string }{
+		{http.MethodGet, PathValues + "a", ""},
+		{http.MethodHead, PathValues + "a", ""},
+		{http.MethodGet, PathStats, ""},
+		{http.MethodPost, PathBulkGet, `["a"]`},
+	}
+	for _, c := range reads {
+		if w := do(s, c.method, c.target, c.body); w.Code != http.StatusOK {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.target, w.Code, http.StatusOK)
+		}
+	}
+
+	// Turned off at runtime by the admin
+	r := httptest.NewRequest(http.MethodPost, PathReadOnly+"?enabled=false", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || s.ReadOnly() {
+		t.Errorf("Admin toggle: got status %d, read-only: %t", w.Code, s.ReadOnly())
+	}
+	if w := do(s, http.MethodPut, PathValues+"b", "2"); w.Code != http.StatusCreated {
+		t.Errorf("PUT after toggle: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	s := newTestServer()
+	s.Idempotency = NewIdempotencyCache(time.Minute, 10)
+	incr := func(client, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, PathValues+"n/incr?by=1", strings.NewReader(body))
+		r.Header.Set(HeaderIdempotencyKey, "k1")
+		r.Header.Set(HeaderOwner, client)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := incr("alice", "")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("First: got status %d (replayed: %q)", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if w := incr("alice", ""); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Retry: got status %d, want replayed response", w.Code)
+	}
+
+	// The same key with a different body is rejected.
+	w = incr("alice", "other")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Different body: got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	} else if code := errorCode(t, w); code != CodeIdempotencyMismatch {
+		t.Errorf("Different body: got code %q, want %q", code, CodeIdempotencyMismatch)
+	}
+
+	// Keys are scoped to the client.
+	if w := incr("bob", ""); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Other client: got status %d (replayed: %q), want executed", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if value, _ := s.store.Get("n"); value != "2" {
+		t.Errorf("Got value %q, want %q", value, "2")
+	}
+}
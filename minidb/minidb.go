@@ -11,202 +11,551 @@ Operations on the mini database are done via HTTP calls.
 Full specification can be found here:
 https://github.com/arschles/go-progprobs/blob/master/minidb.md
 
+Beyond the specification, the server offers reads without locking, conditional writes,
+lock TTLs and fencing tokens, multi-key operations, buckets, change feeds, and admin and
+operational endpoints. The endpoints are registered in NewServer and documented at their
+handlers, optional features (persistence, limits, clustering, replication etc.) at their
+flags (see -help).
+
+Error responses are JSON objects of the form {"error": {"code": code, "message": message}},
+where code is a stable, machine-readable string (see the Code constants).
+
 Implementation notes
 
 I was told it is preferable to use the standard library, so everything here
 is done using only the standard library.
 
+The key/value store is implemented by the Store type, and Server serves
+a Store over HTTP, so isolated instances can be created (e.g. for testing).
+Go programs may use the client subpackage instead of hand-crafting the HTTP calls.
+
 */
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 )
 
 const (
-	PathReservations = "/reservations/" // Path of the /reservations/ endpoint
-	PathValues       = "/values/"       // Path of the /values/ endpoint
-	Port             = 8080             // Port to listen on
-	LockIdLength     = 16               // Length of lock ids (in bytes, will be double when encoded to hex)
+	PathReservations = "/reservations/"        // Path of the /reservations/ endpoint
+	PathMultiReserve = "/reservations"         // Path of the /reservations endpoint (multiple keys)
+	PathReleaseEach  = "/reservations/release" // Path of the /reservations/release endpoint
+	PathValues       = "/values/"              // Path of the /values/ endpoint
+	PathValueQuery   = "/values"               // Path of the /values endpoint (key in the query)
+	PathBulk         = "/bulk"                 // Path of the /bulk endpoint
+	PathBulkGet      = "/bulk/get"             // Path of the /bulk/get endpoint
+	PathAdmin        = "/admin/"               // Path prefix of the admin endpoints
+	PathAdminUnlock  = "/admin/unlock/"        // Path of the /admin/unlock/ endpoint
+	PathAdminFlush   = "/admin/flush"          // Path of the /admin/flush endpoint
+	PathAdminValues  = "/admin/values"         // Path of the /admin/values endpoint
+	PathAdminAudit   = "/admin/audit"          // Path of the /admin/audit endpoint
+	PathAdminLocks   = "/admin/locks"          // Path of the /admin/locks endpoint
+	PathReadOnly     = "/admin/readonly"       // Path of the /admin/readonly endpoint
+	PathEvents       = "/events"               // Path of the /events endpoint
+	PathChanges      = "/changes"              // Path of the /changes endpoint
+	PathExport       = "/export"               // Path of the /export endpoint
+	PathImport       = "/import"               // Path of the /import endpoint
+	PathPprof        = "/debug/pprof/"         // Path of the profiling endpoints (if enabled)
+	PathDebugVars    = "/debug/vars"           // Path of the expvar endpoint (if enabled)
+	PathBuckets      = "/buckets"              // Path of the /buckets endpoint
+	PathStats        = "/stats"                // Path of the /stats endpoint
+	PathStatsHot     = "/stats/hot"            // Path of the /stats/hot endpoint
+	PathMetrics      = "/metrics"              // Path of the /metrics endpoint
+	PathHealthz      = "/healthz"              // Path of the /healthz endpoint
+	PathReadyz       = "/readyz"               // Path of the /readyz endpoint
+	PathVersion      = "/version"              // Path of the /version endpoint
+	DefaultPort      = 8080                    // Default port to listen on
+	LockIdLength     = 16                      // Default (and minimum) length of lock ids (in random bytes, will be double when encoded to hex)
+	MaxKeyLength     = 512                     // Default maximum length of keys (in bytes)
+	MaxValueSize     = 1 << 20                 // Default maximum size of values (in bytes)
+	MaxBulkKeys      = 1000                    // Default maximum number of keys in bulk get requests
+	MaxImportSize    = 256 << 20               // Default maximum size of import bodies (in bytes)
+	GzipMinSize      = 1024                    // Default minimum size of responses to compress (in bytes)
+	DefaultShards    = 32                      // Default number of shards of the store
+	HealthTimeout    = time.Second             // Max time to wait for the store in health checks
+	WatchTimeout     = 30 * time.Second        // Default max time to wait for changes in watch requests
 )
 
-// valueWr struct is a wrapper which holds the value and its lock
-type valueWr struct {
-	Value  string      // The value
-	LockId string      // Lock ID
-	Mux    *sync.Mutex // Lock used to maintain mutual exclusion
-}
+// Build info, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev" // Version of the build
+	commit  = "dev" // Git commit of the build
+	date    = "dev" // Date of the build
+)
 
-// Lock waits for the value to be available and acquires the lock,
-// and generates a new lock id.
-// Should only be called from a handler (because it unlocks store mutex while waiting).
-func (vw *valueWr) Lock() {
-	// While we wait, we have to release the store mutex
-	// else noone else would be able to release the value we're waiting for:
-	storeMux.Unlock()
-	defer storeMux.Lock()
-
-	vw.Mux.Lock()
-	vw.LockId = genLockId()
-}
+// port is the port to listen on, set by the -port flag.
+var port = flag.Int("port", 0, "port to listen on (defaults to the PORT env var, then 8080)")
 
-// Unlock releases the lock for the value and invalidates previous lock id.
-func (vw *valueWr) Unlock() {
-	vw.LockId = ""
-	vw.Mux.Unlock()
-}
+// sweepInterval is the interval of checking expired locks, set by the -sweep-interval flag.
+var sweepInterval = flag.Duration("sweep-interval", time.Second, "interval of releasing expired locks")
 
-// SendJSONResp sends a JSON response inlcuding the LockId, and optionally the Value.
-func (vw *valueWr) SendJSONResp(w http.ResponseWriter, sendValue bool) error {
-	w.Header().Set("Content-Type", "application/json")
-	m := map[string]string{"lock_id": vw.LockId}
-	if sendValue {
-		m["value"] = vw.Value
-	}
-	return json.NewEncoder(w).Encode(m)
-}
+// valueSweepInterval is the interval of deleting expired values, set by the -value-sweep-interval flag.
+var valueSweepInterval = flag.Duration("value-sweep-interval", time.Second, "interval of deleting expired values (set with PUT ?ttl=)")
 
-// The in-memory store realized with a map which maps from key (string)
-// to *valueWr which contains the value (string) and also its the lock.
-var store = make(map[string]*valueWr)
+// shards is the number of shards of the store, set by the -shards flag.
+var shards = flag.Int("shards", DefaultShards, "number of shards of the store (more shards means less lock contention between keys)")
 
-// Mutex used to synchronize access to the store.
-var storeMux = &sync.RWMutex{} // RWMutex which would allow efficient read-only locking for future read-only queries
+// maxWaiters is the max number of waiters for the lock of a key, set by the -max-waiters flag.
+var maxWaiters = flag.Int("max-waiters", 0, "max number of requests waiting for the lock of a key (more get 503), 0 means no limit")
 
-// reservationsHandler is a request handler which handles the endpoint
-// mapped to /reservations/.
-func reservationsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Bad request, POST method expected!", http.StatusBadRequest)
-		return
-	}
+// Lock watchdog settings, set by the -lock-watchdog and -lock-watchdog-release flags.
+var (
+	lockWatchdog        = flag.Duration("lock-watchdog", 0, "log locks held longer than this (and report them in /stats), 0 disables the watchdog")
+	lockWatchdogRelease = flag.Bool("lock-watchdog-release", false, "force-release locks held longer than the -lock-watchdog threshold")
+)
 
-	// POST /reservations/{key}
-	key := r.URL.Path[len(PathReservations):] // Path length is at least len(PathReservations) else we wouldn't be here
+// auditSize is the number of records kept in the audit log, set by the -audit-size flag.
+var auditSize = flag.Int("audit-size", 1000, "number of mutating requests kept in the audit log (see /admin/audit), 0 disables the audit log")
 
-	storeMux.Lock()
-	defer storeMux.Unlock()
+// changeHistory is the number of recent changes kept, set by the -change-history flag.
+var changeHistory = flag.Int("change-history", eventHistorySize, "number of recent changes kept for /changes and for resuming /events streams")
 
-	vw := store[key]
-	if vw == nil {
-		http.NotFound(w, r)
-		return
-	}
+// maxKeys is the max number of keys, set by the -max-keys flag.
+var maxKeys = flag.Int("max-keys", 0, "max number of keys, least recently used unlocked keys are evicted over it, 0 means no limit")
+
+// maxBytes is the max total size of the values, set by the -max-bytes flag.
+var maxBytes = flag.Int64("max-bytes", 0, "max total size of the values in bytes, least recently used unlocked keys are evicted over it (507 if that's not enough), 0 means no limit")
+
+// compressValues is the min size of values stored compressed, set by the -compress-values flag.
+var compressValues = flag.Int("compress-values", 0, "store values at least this many bytes compressed in memory (trading CPU for memory), 0 disables compression")
+
+// maxKeyLength is the maximum length of keys, set by the -max-key-length flag.
+var maxKeyLength = flag.Int("max-key-length", MaxKeyLength, "maximum length of keys in bytes")
+
+// maxValueSize is the maximum size of values, set by the -max-value-size flag.
+var maxValueSize = flag.Int64("max-value-size", MaxValueSize, "maximum size of values in bytes")
+
+// maxBulkKeys is the maximum number of keys in bulk get requests, set by the -max-bulk-keys flag.
+var maxBulkKeys = flag.Int("max-bulk-keys", MaxBulkKeys, "maximum number of keys in bulk get requests")
+
+// maxImportSize is the maximum size of import bodies, set by the -max-import-size flag.
+var maxImportSize = flag.Int64("max-import-size", MaxImportSize, "maximum size of import bodies in bytes")
+
+// basicAuth is the basic auth credentials required by the endpoints in the form "user:pass",
+// set by the -auth flag (defaults to the MINIDB_AUTH env var).
+var basicAuth = flag.String("auth", "", `basic auth credentials required by the endpoints in the form "user:pass" (defaults to the MINIDB_AUTH env var), no auth if empty`)
+
+// Response compression settings, set by the -gzip and -gzip-min-size flags.
+var (
+	gzipEnabled = flag.Bool("gzip", true, "compress responses with gzip for clients accepting it")
+	gzipMinSize = flag.Int("gzip-min-size", GzipMinSize, "minimum size of responses to compress in bytes")
+)
+
+// jsonValues tells if values sent as JSON are validated, set by the -json-values flag.
+var jsonValues = flag.Bool("json-values", false, `validate values sent with "Content-Type: application/json" (400 if malformed), and record their content type`)
+
+// Idempotency key settings, set by the -idempotency-ttl and -idempotency-keys flags.
+var (
+	idempotencyTTL  = flag.Duration("idempotency-ttl", 10*time.Minute, "time to keep responses of requests with an Idempotency-Key header for replaying to retries, 0 disables idempotency keys")
+	idempotencyKeys = flag.Int("idempotency-keys", 10000, "max number of responses kept for idempotency keys")
+)
+
+// corsOrigins is the comma separated list of origins allowed to make cross-origin requests,
+// set by the -cors-origins flag.
+var corsOrigins = flag.String("cors-origins", "", `comma separated list of origins allowed to make cross-origin (CORS) requests, "*" allows any origin, CORS is disabled if empty`)
+
+// maxInFlight is the maximum number of requests processed concurrently, set by the -max-in-flight flag.
+var maxInFlight = flag.Int("max-in-flight", 0, "max number of requests processed concurrently (not counting requests waiting for locks), 0 means no limit")
+
+// Rate limiting settings, set by the -rate-limit, -rate-burst and -trust-forwarded-for flags.
+var (
+	rateLimit         = flag.Float64("rate-limit", 0, "max requests per second per client IP, 0 means no limit")
+	rateBurst         = flag.Int("rate-burst", 10, "max burst of requests per client IP when rate limiting")
+	trustForwardedFor = flag.Bool("trust-forwarded-for", false, "take the client IP from the X-Forwarded-For header when rate limiting (only behind a trusted proxy)")
+)
+
+// adminToken is the bearer token of the admin endpoints, set by the -admin-token flag
+// (defaults to the MINIDB_ADMIN_TOKEN env var).
+var adminToken = flag.String("admin-token", "", "bearer token required by the admin endpoints (defaults to the MINIDB_ADMIN_TOKEN env var), admin endpoints are disabled if empty")
+
+// lockIdLengthFlag is the number of random bytes of lock ids, set by the -lock-id-length flag.
+var lockIdLengthFlag = flag.Int("lock-id-length", LockIdLength, fmt.Sprintf("number of random bytes of lock ids (at least %d)", LockIdLength))
 
-	// Wait to be available and acquire lock:
-	vw.Lock()
-	vw.SendJSONResp(w, true)
+// lockIdEncodingFlag is the encoding of lock ids, set by the -lock-id-encoding flag.
+var lockIdEncodingFlag = flag.String("lock-id-encoding", LockIdHex, `encoding of lock ids: "hex" or "base64" (URL-safe, more compact)`)
+
+// logFormat is the format of the request log, set by the -log-format flag.
+var logFormat = flag.String("log-format", LogFormatText, `format of the request log: "text" (plain text to stderr) or "json" (JSON lines to stdout)`)
+
+// slowThreshold is the duration over which requests are logged as slow, set by the -slow-threshold flag.
+var slowThreshold = flag.Duration("slow-threshold", time.Minute, "log requests taking longer than this as warnings (requests waiting for locks or changes are flagged as waiting), 0 disables it")
+
+// jsonStyleFlag is the style of the field names of JSON responses, set by the -json-style flag.
+var jsonStyleFlag = flag.String("json-style", JSONStyleSnake, `style of the field names of JSON responses: "snake" (e.g. lock_id) or "camel" (e.g. lockId)`)
+
+// enableDebug tells if the debug endpoints (profiling and expvar) should be mounted,
+// set by the -pprof flag.
+var enableDebug = flag.Bool("pprof", false, "mount the debug endpoints: net/http/pprof under /debug/pprof/ and expvar at /debug/vars (exposes internals, use for diagnostics only)")
+
+// shutdownTimeout is the max time to wait for in-flight requests on shutdown,
+// set by the -shutdown-timeout flag.
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "max time to wait for in-flight requests on shutdown")
+
+// shutdownDelay is the time to keep serving after reporting not ready on shutdown,
+// set by the -shutdown-delay flag.
+var shutdownDelay = flag.Duration("shutdown-delay", 0, "time to keep serving on shutdown after /readyz reports not ready (so load balancers can stop routing)")
+
+// Timeouts of the HTTP server, set by the -read-timeout, -write-timeout and -idle-timeout flags.
+// Note that unless -reserve-timeout is set, the write timeout also covers the time a reservation
+// spends waiting for the lock: a reservation may wait longer than the write timeout, but then its
+// response can't be sent (and the acquired lock is only released if it has a TTL). So without
+// -reserve-timeout the write timeout should be generous, and clients should use the timeout
+// parameter of reservations to bound waits.
+var (
+	readTimeout  = flag.Duration("read-timeout", 30*time.Second, "max duration for reading an entire request, 0 means no timeout")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Minute, "max duration before timing out writes of the response (including reservation waits), 0 means no timeout")
+	idleTimeout  = flag.Duration("idle-timeout", 2*time.Minute, "max time to wait for the next request on keep-alive connections, 0 means no timeout")
+)
+
+// bodyTimeout is the max time to receive request bodies, set by the -body-timeout flag.
+var bodyTimeout = flag.Duration("body-timeout", 10*time.Second, "max time to receive request bodies (values) from slow clients, 0 means no timeout")
+
+// reserveTimeout is the max time reservations wait for locks, set by the -reserve-timeout flag.
+var reserveTimeout = flag.Duration("reserve-timeout", 0, "max time reservations wait for locks, with their own response deadline independent of -write-timeout, 0 means waits are only bounded by -write-timeout")
+
+// TLS certificate and key files, set by the -tls-cert and -tls-key flags.
+// If both are set, the server is served over HTTPS.
+var (
+	tlsCert = flag.String("tls-cert", "", "path of the TLS certificate file, serve HTTPS if given (requires -tls-key)")
+	tlsKey  = flag.String("tls-key", "", "path of the TLS private key file, serve HTTPS if given (requires -tls-cert)")
+)
+
+// snapshot is the path of the snapshot file, set by the -snapshot flag.
+var snapshot = flag.String("snapshot", "", "path of the snapshot file to load on startup and save on shutdown (optional)")
+
+// Cluster settings, set by the -peers, -self and -peer-secret flags
+// (the latter defaults to the MINIDB_PEER_SECRET env var).
+var (
+	peers      = flag.String("peers", "", "comma separated list of the base URLs of all nodes of the cluster (including this one, e.g. http://node1:8080), requests for keys owned by other nodes are proxied to them; single node if empty")
+	self       = flag.String("self", "", "base URL of this node as listed in -peers")
+	peerSecret = flag.String("peer-secret", "", "secret shared by the nodes of the cluster, authenticating the requests they proxy to each other (defaults to the MINIDB_PEER_SECRET env var), required with -peers")
+)
+
+// Read replica settings, set by the -primary and -replication-interval flags.
+var (
+	primary             = flag.String("primary", "", "base URL of the primary: run as a read replica, serving reads from a copy replicated from the primary, and proxying writes to it")
+	replicationInterval = flag.Duration("replication-interval", 500*time.Millisecond, "interval of polling the changes of the primary (read replicas only)")
+)
+
+// readOnly tells if mutations are rejected, set by the -read-only flag.
+var readOnly = flag.Bool("read-only", false, "reject all mutating requests with 503 Service Unavailable (e.g. for maintenance windows), reads keep working")
+
+// seedDir is the directory of files to preload as keys on startup, set by the -seed-dir flag.
+var seedDir = flag.String("seed-dir", "", "directory whose files are loaded as keys (file name) and values (file contents) on startup, after the snapshot and WAL (optional)")
+
+// Write-ahead log settings, set by the -wal, -wal-sync-interval and -compact-interval flags.
+var (
+	walPath         = flag.String("wal", "", "path of the write-ahead log file for durability between snapshots (optional)")
+	walSyncInterval = flag.Duration("wal-sync-interval", 0, "interval of syncing the WAL to disk in batches, 0 means sync after each write")
+	compactInterval = flag.Duration("compact-interval", 0, "interval of folding the WAL into the snapshot, 0 means only on shutdown")
+)
+
+// resolvePort returns the port to listen on: the -port flag if given,
+// else the PORT environment variable if set, else DefaultPort.
+func resolvePort() (int, error) {
+	p := *port
+	if p == 0 {
+		p = DefaultPort
+		if s := os.Getenv("PORT"); s != "" {
+			var err error
+			if p, err = strconv.Atoi(s); err != nil {
+				return 0, fmt.Errorf("Invalid PORT env var: %q", s)
+			}
+		}
+	}
+	if p < 1 || p > 65535 {
+		return 0, fmt.Errorf("Invalid port: %d (must be in range 1..65535)", p)
+	}
+	return p, nil
 }
 
-// valuesHandler is a request handler which handles the endpoints
-// mapped to /values/.
-func valuesHandler(w http.ResponseWriter, r *http.Request) {
-	// 0: empty, 1: "values", 2: key, 3: lockId
-	parts := strings.Split(r.URL.Path, "/")
-	// We expect key in all cases
-	key := parts[2] // If there is no key, this will be empty string
-	if err := checkKey(key); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	storeMux.Lock()
-	defer storeMux.Unlock()
-
-	switch r.Method {
-	case http.MethodPost:
-		// POST /values/{key}/{lock_id}?release={true, false}
-		release := r.URL.Query().Get("release")
-		// According to spec, if release is neither "true" nor "false", nothing should be set
-		if len(parts) < 4 || (release != "false" && release != "true") {
-			http.Error(w, "Bad request, missing lockId and/or release parameter (must be 'true' or 'false')!", http.StatusBadRequest)
-			return
+// main is the entry point of the application.
+func main() {
+	flag.Parse()
+
+	p, err := resolvePort()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *sweepInterval <= 0 {
+		log.Fatalln("Invalid sweep interval:", *sweepInterval)
+	}
+	if *valueSweepInterval <= 0 {
+		log.Fatalln("Invalid value sweep interval:", *valueSweepInterval)
+	}
+	if *shards < 1 {
+		log.Fatalln("Invalid number of shards:", *shards)
+	}
+	if *lockWatchdog < 0 {
+		log.Fatalln("Invalid lock watchdog threshold:", *lockWatchdog)
+	}
+	if *lockWatchdogRelease && *lockWatchdog == 0 {
+		log.Fatalln("-lock-watchdog-release requires -lock-watchdog!")
+	}
+	if *auditSize < 0 {
+		log.Fatalln("Invalid audit size:", *auditSize)
+	}
+	if *changeHistory < 1 {
+		log.Fatalln("Invalid change history:", *changeHistory)
+	}
+	if *maxWaiters < 0 {
+		log.Fatalln("Invalid max waiters:", *maxWaiters)
+	}
+	if *maxKeys < 0 {
+		log.Fatalln("Invalid max keys:", *maxKeys)
+	}
+	if *maxBytes < 0 {
+		log.Fatalln("Invalid max bytes:", *maxBytes)
+	}
+	if *compressValues < 0 {
+		log.Fatalln("Invalid compress values size:", *compressValues)
+	}
+	if *reserveTimeout < 0 {
+		log.Fatalln("Invalid reserve timeout:", *reserveTimeout)
+	}
+	if *maxKeyLength < 1 {
+		log.Fatalln("Invalid max key length:", *maxKeyLength)
+	}
+	if *maxValueSize < 0 {
+		log.Fatalln("Invalid max value size:", *maxValueSize)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalln("Both -tls-cert and -tls-key must be provided to serve HTTPS (or neither to serve HTTP)!")
+	}
+	if err := SetLockIdFormat(*lockIdLengthFlag, *lockIdEncodingFlag); err != nil {
+		log.Fatalln("Invalid lock id format:", err)
+	}
+	if err := SetJSONStyle(*jsonStyleFlag); err != nil {
+		log.Fatalln("Invalid JSON style:", err)
+	}
+	if *logFormat != LogFormatText && *logFormat != LogFormatJSON {
+		log.Fatalln("Invalid log format:", *logFormat)
+	}
+	if *maxInFlight < 0 {
+		log.Fatalln("Invalid max in-flight requests:", *maxInFlight)
+	}
+	if *rateLimit < 0 {
+		log.Fatalln("Invalid rate limit:", *rateLimit)
+	}
+	if *idempotencyTTL < 0 {
+		log.Fatalln("Invalid idempotency TTL:", *idempotencyTTL)
+	}
+	if *idempotencyTTL > 0 && *idempotencyKeys < 1 {
+		log.Fatalln("Invalid max idempotency keys:", *idempotencyKeys)
+	}
+	if *rateLimit > 0 && *rateBurst < 1 {
+		log.Fatalln("Invalid rate burst:", *rateBurst)
+	}
+	var peerList []string
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peerList = append(peerList, peer)
 		}
-		vw := store[key]
-		if vw == nil {
-			http.NotFound(w, r)
-			return
+	}
+	*self = strings.TrimRight(*self, "/")
+	if len(peerList) > 0 {
+		found := false
+		for _, peer := range peerList {
+			found = found || peer == *self
 		}
-		if vw.LockId != parts[3] {
-			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-			return
+		if !found {
+			log.Fatalln("-self must be one of -peers:", *self)
 		}
-		readBody(vw, r) // We ignore returned error
-		if release == "true" {
-			vw.Unlock()
+	}
+	if *primary != "" && len(peerList) > 0 {
+		log.Fatalln("-primary and -peers can't be used together!")
+	}
+	if *replicationInterval <= 0 {
+		log.Fatalln("Invalid replication interval:", *replicationInterval)
+	}
+	if *maxBulkKeys < 1 {
+		log.Fatalln("Invalid max bulk keys:", *maxBulkKeys)
+	}
+
+	if *tlsCert != "" {
+		log.Printf("Starting minidb application (version %s, commit %s) on port %d (HTTPS)...", version, commit, p)
+	} else {
+		log.Printf("Starting minidb application (version %s, commit %s) on port %d...", version, commit, p)
+	}
+
+	store := NewStore(*shards)
+	if *maxKeys > 0 {
+		store.EnableLRU(*maxKeys)
+	}
+	store.SetMaxBytes(*maxBytes)
+	store.SetMaxWaiters(*maxWaiters)
+	store.SetCompression(*compressValues)
+	store.SetChangeHistory(*changeHistory)
+	if *lockWatchdog > 0 {
+		store.EnableWatchdog(*lockWatchdog, *lockWatchdogRelease)
+	}
+	if *snapshot != "" {
+		n, err := store.LoadSnapshot(*snapshot)
+		switch {
+		case err == nil:
+			log.Printf("Loaded %d keys from snapshot %s", n, *snapshot)
+		case errors.Is(err, os.ErrNotExist):
+			log.Printf("Snapshot %s does not exist, starting with an empty store.", *snapshot)
+		default:
+			log.Fatalln("Failed to load snapshot:", err)
 		}
-		w.WriteHeader(http.StatusNoContent)
-	case http.MethodPut:
-		// PUT /values/{key}
-		vw := store[key]
-		if vw == nil {
-			// Key doesn't exist yet: create
-			vw = &valueWr{Mux: &sync.Mutex{}}
-			store[key] = vw
+	}
+	if *walPath != "" {
+		n, err := store.OpenWAL(*walPath, *walSyncInterval)
+		if err != nil {
+			log.Fatalln("Failed to open WAL:", err)
+		}
+		log.Printf("Replayed %d records from WAL %s", n, *walPath)
+		if *snapshot == "" {
+			log.Println("No snapshot file is given, WAL will not be compacted.")
+		} else if *compactInterval > 0 {
+			go func() {
+				for range time.Tick(*compactInterval) {
+					if err := store.SaveSnapshot(*snapshot); err != nil {
+						log.Println("Failed to compact WAL into snapshot:", err)
+					}
+				}
+			}()
 		}
-		// Acquire lock
-		vw.Lock()
-		readBody(vw, r) // Spec says to always return 200, so we ignore returned error
-		vw.SendJSONResp(w, false)
-	default:
-		http.Error(w, "Bad request, POST or PUT method expected!", http.StatusBadRequest)
 	}
-}
-
-// readBody reads the request body and sets it as the new value.
-func readBody(vw *valueWr, r *http.Request) error {
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Println("Error reading request body:", err)
-		return err
+	go store.sweepExpiredLocks(*sweepInterval)
+	go store.sweepExpiredValues(*valueSweepInterval)
+	if *lockWatchdog > 0 {
+		go store.watchLocks(*sweepInterval)
 	}
-	vw.Value = string(content)
-	return nil
-}
 
-var (
-	ErrKeyMissing = errors.New("Key is missing!")
-	ErrKeyInvalid = errors.New("Key must not contain '/'!")
-)
+	srv := NewServer(store)
+	if *enableDebug {
+		srv.EnableDebug()
+		log.Println("Debug endpoints are enabled under /debug/")
+	}
+	srv.MaxKeyLength = *maxKeyLength
+	srv.MaxValueSize = *maxValueSize
+	srv.MaxBulkKeys = *maxBulkKeys
+	srv.MaxImportSize = *maxImportSize
+	srv.BodyTimeout = *bodyTimeout
+	srv.ReserveTimeout = *reserveTimeout
+	srv.MaxInFlight = *maxInFlight
+	for _, o := range strings.Split(*corsOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			srv.CORSOrigins = append(srv.CORSOrigins, o)
+		}
+	}
+	srv.Gzip = *gzipEnabled
+	srv.GzipMinSize = *gzipMinSize
+	srv.JSONValues = *jsonValues
+	if *readOnly {
+		srv.SetReadOnly(true)
+		log.Println("Running in read-only mode.")
+	}
+	if *rateLimit > 0 {
+		srv.RateLimiter = NewRateLimiter(*rateLimit, *rateBurst)
+		srv.RateLimiter.TrustForwardedFor = *trustForwardedFor
+	}
+	if *auditSize > 0 {
+		srv.Audit = NewAuditLog(*auditSize)
+	}
+	if *idempotencyTTL > 0 {
+		srv.Idempotency = NewIdempotencyCache(*idempotencyTTL, *idempotencyKeys)
+	}
+	srv.BasicAuth = *basicAuth
+	if srv.BasicAuth == "" {
+		srv.BasicAuth = os.Getenv("MINIDB_AUTH")
+	}
+	if srv.BasicAuth != "" && !strings.Contains(srv.BasicAuth, ":") {
+		log.Fatalln(`Invalid basic auth credentials, must be in the form "user:pass"!`)
+	}
+	srv.AdminToken = *adminToken
+	if srv.AdminToken == "" {
+		srv.AdminToken = os.Getenv("MINIDB_ADMIN_TOKEN")
+	}
 
-// checkKey checks the specified key and reports if it is not valid.
-func checkKey(key string) error {
-	if key == "" {
-		return ErrKeyMissing
+	if len(peerList) > 0 {
+		if *peerSecret == "" {
+			*peerSecret = os.Getenv("MINIDB_PEER_SECRET")
+		}
+		if err := srv.SetPeers(peerList, *self, *peerSecret); err != nil {
+			log.Fatalln("Invalid peers:", err)
+		}
+		log.Printf("Running as %s in a cluster of %d nodes.", *self, len(peerList))
 	}
-	if strings.IndexByte(key, '/') >= 0 {
-		return ErrKeyInvalid
+	if *primary != "" {
+		rp := NewReplicator(store, *primary, srv.BasicAuth)
+		if err := srv.SetPrimary(*primary, rp); err != nil {
+			log.Fatalln("Invalid primary:", err)
+		}
+		go rp.Run(*replicationInterval)
+		log.Printf("Running as a read replica of %s.", *primary)
+	}
+	if *seedDir != "" {
+		// After the snapshot and the WAL (seeds win), and after srv is configured (for checkKey)
+		n, err := store.LoadSeedDir(*seedDir, srv.checkKey, srv.MaxValueSize)
+		if err != nil {
+			log.Fatalln("Failed to load seed directory:", err)
+		}
+		log.Printf("Loaded %d keys from seed directory %s", n, *seedDir)
 	}
-	return nil
-}
 
-// genLockId generates a new, unique lock id.
-func genLockId() string {
-	buf := make([]byte, LockIdLength)
-	if _, err := rand.Read(buf); err != nil {
-		log.Println("Error reading secure random:", err)
+	httpSrv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", p),
+		Handler:      withRequestID(logRequests(logSlowRequests(srv, *slowThreshold), *logFormat)),
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
 	}
-	return hex.EncodeToString(buf)
-}
+	httpSrv.RegisterOnShutdown(srv.CloseStreams)
+	go func() {
+		var err error
+		if *tlsCert != "" {
+			err = httpSrv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			err = httpSrv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalln("Failed to start server:", err)
+		}
+	}()
 
-// main is the entry point of the application.
-func main() {
-	log.Printf("Starting minidb application on port %d...", Port)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %v signal, shutting down...", <-sigCh)
+
+	srv.SetNotReady()
+	if *shutdownDelay > 0 {
+		log.Printf("Waiting %v for load balancers to stop routing...", *shutdownDelay)
+		time.Sleep(*shutdownDelay)
+	}
 
-	http.HandleFunc(PathReservations, reservationsHandler)
-	http.HandleFunc(PathValues, valuesHandler)
+	inFlight := srv.InFlight()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		log.Println("Failed to shut down gracefully:", err)
+	}
+	log.Printf("Drained %d of %d in-flight requests.", inFlight-srv.InFlight(), inFlight)
 
-	addr := fmt.Sprintf(":%d", Port)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Println("Failed to start server:", err)
+	if *snapshot != "" {
+		if err := store.SaveSnapshot(*snapshot); err != nil {
+			log.Println("Failed to save snapshot:", err)
+		} else {
+			log.Println("Saved snapshot", *snapshot)
+		}
+	}
+	if err := store.CloseWAL(); err != nil {
+		log.Println("Failed to close WAL:", err)
 	}
 }
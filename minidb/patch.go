@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Content types of patches.
+const (
+	ContentTypeJSONPatch  = "application/json-patch+json"  // RFC 6902 JSON Patch
+	ContentTypeMergePatch = "application/merge-patch+json" // RFC 7386 JSON Merge Patch
+)
+
+// PatchError tells that a patch is malformed, can't be applied, or the value
+// to patch is not valid JSON.
+type PatchError struct {
+	msg string
+}
+
+// Error implements error.
+func (e *PatchError) Error() string {
+	return e.msg
+}
+
+// patchErrorf returns a new *PatchError with a formatted message.
+func patchErrorf(format string, a ...interface{}) *PatchError {
+	return &PatchError{msg: fmt.Sprintf(format, a...)}
+}
+
+// Patch applies patch to the value of key, and releases its lock if release is true.
+// lockId must identify the currently held lock of key.
+// patch returns the new value from the current one; its error (if any) is returned as is,
+// and the value is left unchanged. If the new value is longer than maxSize, ErrTooLarge
+// is returned. The content type of the value is kept. Returns ErrNotFound if the value has expired.
+func (s *Store) Patch(key, lockId string, patch func(current string) (string, error), maxSize int64, release bool) error {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw := sh.m[key]
+	value, err := s.patched(vw, lockId, patch, maxSize)
+	if err != nil {
+		return err
+	}
+	rec := putRecord(key, value, vw.ContentType, vw.ValueExpires)
+	if err := s.logMutation(rec); err != nil {
+		return err
+	}
+	s.setRecord(vw, rec)
+	if release {
+		vw.Unlock()
+	}
+	return nil
+}
+
+// patched returns the value of a key whose valueWr is vw (nil if the key doesn't exist)
+// with patch applied, checking everything Patch does before setting it.
+// The shard of vw must be locked by the caller.
+func (s *Store) patched(vw *valueWr, lockId string, patch func(current string) (string, error), maxSize int64) (string, error) {
+	if err := checkUpdatable(vw, lockId); err != nil {
+		return "", err
+	}
+	current, err := vw.value()
+	if err != nil {
+		return "", err
+	}
+	value, err := patch(current)
+	if err != nil {
+		return "", err
+	}
+	if int64(len(value)) > maxSize {
+		return "", ErrTooLarge
+	}
+	if !s.fits(vw, len(value)) {
+		return "", ErrInsufficientStorage
+	}
+	return value, nil
+}
+
+// parsePatch parses the patch in the body of r, and returns a function applying it
+// to JSON documents. The type of the patch is given by the Content-Type header:
+// a JSON Patch (application/json-patch+json, the default) or a JSON Merge Patch
+// (application/merge-patch+json).
+func parsePatch(r *http.Request, body string) (func(doc string) (string, error), error) {
+	mediaType := ContentTypeJSONPatch
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil, patchErrorf("Invalid Content-Type header!")
+		}
+	}
+
+	switch mediaType {
+	case ContentTypeJSONPatch, "application/json":
+		var ops []patchOp
+		if err := json.Unmarshal([]byte(body), &ops); err != nil {
+			return nil, patchErrorf("Patch must be a JSON array of operations!")
+		}
+		return func(doc string) (string, error) {
+			return applyDoc(doc, func(v interface{}) (interface{}, error) {
+				return applyJSONPatch(v, ops)
+			})
+		}, nil
+	case ContentTypeMergePatch:
+		patch, err := decodeJSON(body)
+		if err != nil {
+			return nil, patchErrorf("Merge patch must be valid JSON!")
+		}
+		return func(doc string) (string, error) {
+			return applyDoc(doc, func(v interface{}) (interface{}, error) {
+				return mergePatch(v, patch), nil
+			})
+		}, nil
+	}
+	return nil, patchErrorf("Unsupported patch type %q (must be %s or %s)!", mediaType, ContentTypeJSONPatch, ContentTypeMergePatch)
+}
+
+// applyDoc decodes the JSON document doc, applies f to it, and encodes the result.
+func applyDoc(doc string, f func(v interface{}) (interface{}, error)) (string, error) {
+	v, err := decodeJSON(doc)
+	if err != nil {
+		return "", patchErrorf("Value is not valid JSON, it can't be patched!")
+	}
+	if v, err = f(v); err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false) // Keep the value as close to the original as possible
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// decodeJSON decodes the JSON document s, keeping numbers as is (json.Number).
+func decodeJSON(s string) (v interface{}, err error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err = dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data")
+	}
+	return v, nil
+}
+
+// mergePatch applies the JSON Merge Patch patch to the document target (RFC 7386).
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// patchOp is an operation of a JSON Patch (RFC 6902).
+type patchOp struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies the operations of a JSON Patch to doc, in order (RFC 6902).
+// If any of them fails, the error is returned (and the patch is not applied).
+// A failing test operation is reported with ErrMismatch.
+func applyJSONPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, patchErrorf("Operation %d: missing path!", i)
+		}
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, patchErrorf("Operation %d: %v", i, err)
+		}
+		var value, current interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, patchErrorf("Operation %d: missing value!", i)
+			}
+			if value, err = decodeJSON(string(*op.Value)); err != nil {
+				return nil, patchErrorf("Operation %d: invalid value!", i)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, patchErrorf("Operation %d: missing from!", i)
+			}
+			from, err := parsePointer(*op.From)
+			if err != nil {
+				return nil, patchErrorf("Operation %d: %v", i, err)
+			}
+			if value, err = getPointer(doc, from); err != nil {
+				return nil, patchErrorf("Operation %d: %v", i, err)
+			}
+			if op.Op == "move" {
+				if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+					return nil, patchErrorf("Operation %d: can't move a value into itself!", i)
+				}
+				if doc, err = removePointer(doc, from); err != nil {
+					return nil, patchErrorf("Operation %d: %v", i, err)
+				}
+			} else {
+				value = deepCopy(value)
+			}
+		case "remove":
+		default:
+			return nil, patchErrorf("Operation %d: unknown op %q!", i, op.Op)
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = addPointer(doc, path, value)
+		case "remove":
+			doc, err = removePointer(doc, path)
+		case "replace":
+			if _, err = getPointer(doc, path); err == nil {
+				doc, err = setPointer(doc, path, value)
+			}
+		case "test":
+			if current, err = getPointer(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+				return nil, ErrMismatch
+			}
+		}
+		if err != nil {
+			return nil, patchErrorf("Operation %d: %v", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer parses the JSON Pointer p (RFC 6901) into its unescaped reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil // The whole document
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid path %q, must be empty or start with '/'", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the token t as an index of an array of length n.
+// If end is true, n (the end, also denoted by "-") is a valid index too.
+func arrayIndex(t string, n int, end bool) (int, error) {
+	if end && t == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(t)
+	if err != nil || i < 0 || i > n || (i == n && !end) || (len(t) > 1 && t[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", t)
+	}
+	return i, nil
+}
+
+// getPointer returns the value at path in doc.
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("path not found (at %q)", t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("path not found (at %q)", t)
+		}
+	}
+	return doc, nil
+}
+
+// modifyPointer calls f with the container holding the last token of path (and the token),
+// and returns doc with the container replaced by the result of f.
+// path must not be empty.
+func modifyPointer(doc interface{}, path []string, f func(container interface{}, t string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	child, err := getPointer(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = modifyPointer(child, path[1:], f); err != nil {
+		return nil, err
+	}
+	return setPointer(doc, path[:1], child)
+}
+
+// setPointer sets the existing value at path in doc to value.
+func setPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return modifyPointer(doc, path, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[t] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("path not found (at %q)", t)
+	})
+}
+
+// addPointer adds value at path in doc: sets a member of an object,
+// or inserts an element into an array.
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return modifyPointer(doc, path, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[t] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("path not found (at %q)", t)
+	})
+}
+
+// removePointer removes the value at path from doc.
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("can't remove the whole document")
+	}
+	return modifyPointer(doc, path, func(container interface{}, t string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[t]; !ok {
+				return nil, fmt.Errorf("path not found (at %q)", t)
+			}
+			delete(c, t)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("path not found (at %q)", t)
+	})
+}
+
+// deepCopy returns a deep copy of the decoded JSON value v.
+func deepCopy(v interface{}) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(c))
+		for k, e := range c {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(c))
+		for i, e := range c {
+			a[i] = deepCopy(e)
+		}
+		return a
+	}
+	return v
+}
+
+// patch handles the PATCH endpoint, applying a JSON Patch or a JSON Merge Patch
+// to the value of key.
+func (s *Server) patch(w http.ResponseWriter, r *http.Request, key string, parts []string, dry bool) {
+	// PATCH /values/{key}/{lock_id}?release={true, false}
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	release := r.URL.Query().Get("release")
+	if len(parts) < 2 || (release != "false" && release != "true") {
+		badRequest(w, "Missing lockId and/or release parameter (must be 'true' or 'false')!")
+		return
+	}
+	if !validateLockId(w, parts[1]) {
+		return
+	}
+	apply, err := parsePatch(r, body)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+
+	if dry {
+		var value string
+		_, err := s.store.Probe(key, func(vw *valueWr) (err error) {
+			value, err = s.store.patched(vw, parts[1], apply, s.MaxValueSize)
+			return err
+		})
+		if err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		sendDryRun(w, map[string]interface{}{"value": value, "released": release == "true"})
+		return
+	}
+
+	if err := s.store.Patch(key, parts[1], apply, s.MaxValueSize, release == "true"); err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
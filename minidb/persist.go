@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Values returns a copy of all keys and their values (without the expired values).
+// Locks are not included.
+func (s *Store) Values() (map[string]string, error) {
+	now := time.Now()
+	values := make(map[string]string)
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		for key, vw := range sh.m {
+			if vw.valueExpired(now) {
+				continue
+			}
+			value, err := vw.value()
+			if err != nil {
+				sh.mux.RUnlock()
+				return nil, fmt.Errorf("key %q: %w", key, err)
+			}
+			values[key] = value
+		}
+		sh.mux.RUnlock()
+	}
+	return values, nil
+}
+
+// Restore sets the keys of entries to their values (with their content types and expiries).
+// Keys that don't exist are created (unlocked), existing keys keep their lock state.
+func (s *Store) Restore(entries []entry) {
+	for _, e := range entries {
+		sh := s.shard(e.Key)
+		sh.mux.Lock()
+		vw := sh.m[e.Key]
+		if vw == nil {
+			vw = newValueWr()
+			sh.m[e.Key] = vw
+		}
+		s.setRecord(vw, walRecord{Op: OpPut, Key: e.Key, Value: e.Value, ContentType: e.ContentType, Expires: e.Expires})
+		sh.mux.Unlock()
+		s.touch(e.Key)
+	}
+}
+
+// SaveSnapshot writes all keys and their values (with their content types and expiries,
+// without the expired values) to the snapshot file at path as a JSON array of entries
+// (see entry). Locks are not saved, they are bound to the clients' sessions.
+//
+// The snapshot is written atomically: it is written to a temporary file first,
+// which is then renamed to path.
+//
+// If a write-ahead log is attached, it is truncated as its records are folded into
+// the snapshot (compaction). The store is blocked for writing meanwhile, so the
+// snapshot and the log are consistent. If a value is corrupt, no snapshot is written
+// (so the log is kept).
+func (s *Store) SaveSnapshot(path string) error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	now := time.Now()
+	var entries []entry
+	for _, sh := range s.shards {
+		for key, vw := range sh.m {
+			if vw.valueExpired(now) {
+				continue
+			}
+			e, err := vw.entry(key)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	if err := writeSnapshot(path, entries); err != nil {
+		return err
+	}
+	if s.wal != nil {
+		return s.wal.Truncate()
+	}
+	return nil
+}
+
+// writeSnapshot writes entries to the snapshot file at path atomically.
+func writeSnapshot(path string, entries []entry) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if entries == nil {
+		entries = []entry{} // An empty array instead of null
+	}
+	if err = json.NewEncoder(f).Encode(entries); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot loads keys and their values from the snapshot file at path,
+// written by SaveSnapshot. Snapshots of older versions (a JSON object of the values,
+// without content types and expiries) are also accepted.
+// Returns the number of loaded keys.
+func (s *Store) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	start, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if start != json.Delim('[') && start != json.Delim('{') {
+		return 0, fmt.Errorf("invalid snapshot: starts with %v", start)
+	}
+	var entries []entry
+	for dec.More() {
+		var e entry
+		if start == json.Delim('{') {
+			key, err := dec.Token()
+			if err != nil {
+				return 0, err
+			}
+			e.Key = key.(string) // Object keys are always strings
+			if err := dec.Decode(&e.Value); err != nil {
+				return 0, err
+			}
+		} else if err := dec.Decode(&e); err != nil {
+			return 0, err
+		}
+		entries = append(entries, e)
+	}
+	s.Restore(entries)
+	return len(entries), nil
+}
+
+// LoadSeedDir loads keys from the files of the directory dir: each file becomes a key
+// (its name) with the contents of the file as its value, like Restore.
+// Files whose name is rejected by checkKey, files larger than maxSize, and anything
+// but regular files (e.g. subdirectories) are skipped (and logged).
+// Returns the number of loaded keys.
+func (s *Store) LoadSeedDir(dir string, checkKey func(key string) error, maxSize int64) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var values []entry
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() {
+			log.Printf("Skipping seed file %q: not a regular file.", name)
+			continue
+		}
+		if err := checkKey(name); err != nil {
+			log.Printf("Skipping seed file %q: %v", name, err)
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(data)) > maxSize {
+			log.Printf("Skipping seed file %q: larger than the max value size (%d bytes).", name, maxSize)
+			continue
+		}
+		values = append(values, entry{Key: name, Value: string(data)})
+	}
+	s.Restore(values)
+	return len(values), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	values := map[string]string{
+		"plain":   "value",
+		"empty":   "",
+		"unicode": "héllo, 世界 🌍",
+	}
+	s := newTestServer()
+	for key, value := range values {
+		put(t, s, key, value)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := s.store.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	// "Restart"
+	s = newTestServer()
+	n, err := s.store.LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if n != len(values) {
+		t.Errorf("Loaded %d keys, want %d", n, len(values))
+	}
+	for key, want := range values {
+		w := do(s, http.MethodGet, PathValues+key, "")
+		var resp struct {
+			Value string `json:"value"`
+		}
+		decode(t, w, &resp)
+		if w.Code != http.StatusOK || resp.Value != want {
+			t.Errorf("GET %s: got status %d, value %q, want %q", key, w.Code, resp.Value, want)
+		}
+		// Locks are not persisted.
+		if w := do(s, http.MethodPost, PathReservations+key+"?wait=false", ""); w.Code != http.StatusOK {
+			t.Errorf("Key %s is locked after load (status %d)", key, w.Code)
+		}
+	}
+}
+
+// valueExpires returns the expiry time of the value of key (the zero value if it never expires).
+func valueExpires(s *Store, key string) time.Time {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+	if vw := sh.m[key]; vw != nil {
+		return vw.ValueExpires
+	}
+	return time.Time{}
+}
+
+func TestSnapshotTTL(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	if _, _, err := s.store.Put(ctx, "a", `{"x":1}`, "application/json", time.Hour); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, _, err := s.store.Put(ctx, "b", "2", "", time.Nanosecond); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	expires := valueExpires(s.store, "a")
+	time.Sleep(time.Millisecond) // Let b expire
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := s.store.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	s = newTestServer()
+	if n, err := s.store.LoadSnapshot(path); err != nil || n != 1 {
+		t.Fatalf("LoadSnapshot: loaded %d keys (%v), want 1", n, err)
+	}
+	if got := valueExpires(s.store, "a"); !got.Equal(expires) {
+		t.Errorf("Got expiry %v for a, want %v", got, expires)
+	}
+	if meta, _ := s.store.Meta("a"); meta.ContentType != "application/json" {
+		t.Errorf("Got content type %q for a, want %q", meta.ContentType, "application/json")
+	}
+	if _, ok := s.store.Meta("b"); ok {
+		t.Error("Expired b is saved")
+	}
+}
+
+func TestLoadSnapshotObject(t *testing.T) {
+	// Snapshots of older versions are an object of the values.
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(path, []byte(`{"a": "1", "b": ""}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	if n, err := s.store.LoadSnapshot(path); err != nil || n != 2 {
+		t.Fatalf("LoadSnapshot: loaded %d keys (%v), want 2", n, err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": ""} {
+		if value, err := s.store.Get(key); err != nil || value != want {
+			t.Errorf("Got value %q (%v) for %s, want %q", value, err, key, want)
+		}
+	}
+}
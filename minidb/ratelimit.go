@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket of a client.
+type bucket struct {
+	tokens float64   // Available tokens as of the last update
+	last   time.Time // Time of the last update of tokens
+}
+
+// RateLimiter limits the rate of requests per client IP using token buckets:
+// each client has a bucket of burst tokens which is refilled at rate tokens per second,
+// and each request takes a token.
+//
+// Its methods are safe for concurrent use.
+type RateLimiter struct {
+	rate  float64 // Tokens added per second
+	burst float64 // Capacity of the buckets
+
+	// TrustForwardedFor tells if the client IP should be taken from the
+	// X-Forwarded-For header (if present). Only enable it behind a trusted proxy,
+	// else clients can spoof their IPs.
+	TrustForwardedFor bool
+
+	mux       sync.Mutex
+	buckets   map[string]*bucket // Buckets by client IP
+	lastSweep time.Time          // Time of the last removal of idle buckets
+}
+
+// NewRateLimiter creates a new RateLimiter allowing rate requests per second
+// with bursts of up to burst requests per client.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of client if there is one available.
+// If not, it returns false and the duration after which a token becomes available.
+func (rl *RateLimiter) Allow(client string) (ok bool, retryAfter time.Duration) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	b := rl.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	} else {
+		b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets which have been idle long enough to be full
+// (which is the same as having no bucket), so memory doesn't grow unbounded.
+// Sweeping is done at most once per the time it takes to refill a bucket.
+// rl.mux must be locked by the caller.
+func (rl *RateLimiter) sweep(now time.Time) {
+	refill := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	if now.Sub(rl.lastSweep) < refill {
+		return
+	}
+	for client, b := range rl.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(rl.buckets, client)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// clientIP returns the IP of the client of r.
+func (rl *RateLimiter) clientIP(r *http.Request) string {
+	if rl.TrustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			// First entry is the original client
+			ip, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit returns a handler which limits the rate of requests of clients of next
+// using s.RateLimiter (if set), responding with 429 Too Many Requests to requests
+// over the limit.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.RateLimiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, retryAfter := s.RateLimiter.Allow(s.RateLimiter.clientIP(r)); !ok {
+			secs := int(math.Ceil(retryAfter.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			writeError(w, http.StatusTooManyRequests, CodeRateLimited, "Too many requests!")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
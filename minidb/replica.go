@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const replicaBatch = DefaultChangesLimit // Max number of changes fetched from the primary at once
+
+// ReplicationStats is the state of the replication of a read replica.
+type ReplicationStats struct {
+	Primary    string    `json:"primary"`     // Base URL of the primary
+	AppliedSeq uint64    `json:"applied_seq"` // Sequence number of the last applied change
+	PrimarySeq uint64    `json:"primary_seq"` // Sequence number of the last change of the primary (when last polled)
+	Lag        uint64    `json:"lag"`         // Number of changes not yet applied: PrimarySeq - AppliedSeq
+	LastSync   time.Time `json:"last_sync"`   // Time of the last successful poll of the primary
+}
+
+// Replicator keeps a store in sync with a primary server, tailing its changes (/changes).
+// When the changes it needs are not kept by the primary anymore (e.g. on startup),
+// it resyncs: loads all keys from the primary (/export), then tails the changes from there.
+type Replicator struct {
+	store     *Store
+	primary   string       // Base URL of the primary
+	basicAuth string       // Basic auth credentials for the primary ("user:pass"), if any
+	hc        *http.Client // HTTP client doing the requests
+
+	appliedSeq uint64 // Sequence number of the last applied change, must be accessed atomically
+	primarySeq uint64 // Sequence number of the last change of the primary, must be accessed atomically
+	lastSync   int64  // Unix time (in nanoseconds) of the last successful poll, must be accessed atomically
+}
+
+// NewReplicator creates a new Replicator of store from the primary at the base URL primary.
+// basicAuth are the credentials of the primary (in the form "user:pass", empty if none).
+func NewReplicator(store *Store, primary, basicAuth string) *Replicator {
+	return &Replicator{
+		store:     store,
+		primary:   strings.TrimRight(primary, "/"),
+		basicAuth: basicAuth,
+		hc:        &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Run replicates the changes of the primary, polling it every interval.
+// It never returns, should be launched as a new goroutine.
+func (rp *Replicator) Run(interval time.Duration) {
+	synced := false
+	for ; ; time.Sleep(interval) {
+		if !synced {
+			if err := rp.resync(); err != nil {
+				log.Println("Failed to resync from primary:", err)
+				continue
+			}
+			synced = true
+		}
+		for {
+			n, err := rp.poll()
+			if err == errResync {
+				log.Println("Changes are not kept by the primary anymore, resyncing...")
+				synced = false
+				break
+			}
+			if err != nil {
+				log.Println("Failed to replicate from primary:", err)
+				break
+			}
+			if n < replicaBatch {
+				break // Caught up
+			}
+		}
+	}
+}
+
+// errResync tells that the changes needed are not kept by the primary anymore.
+var errResync = fmt.Errorf("resync required")
+
+// resync loads all keys from the primary, replacing the keys of the store,
+// and sets the applied sequence number to the last change of the primary before the export.
+// Changes during the export are applied again by the subsequent polls, which is harmless.
+func (rp *Replicator) resync() error {
+	// No changes are after MaxUint64, so this only returns the Last-Seq header
+	resp, err := rp.get("/changes?limit=1&since=" + strconv.FormatUint(math.MaxUint64, 10))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	seq, err := strconv.ParseUint(resp.Header.Get(HeaderLastSeq), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header: %w", HeaderLastSeq, err)
+	}
+
+	if resp, err = rp.get("/export"); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	entries := make(map[string]entry)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e entry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		entries[e.Key] = e
+	}
+	if _, err := rp.store.Import(entries, true); err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&rp.appliedSeq, seq)
+	atomic.StoreUint64(&rp.primarySeq, seq)
+	atomic.StoreInt64(&rp.lastSync, time.Now().UnixNano())
+	log.Printf("Resynced %d keys from primary %s (at change %d).", len(entries), rp.primary, seq)
+	return nil
+}
+
+// poll fetches and applies the next batch of changes from the primary.
+// Returns the number of applied changes, and errResync if the changes needed
+// are not kept by the primary anymore.
+func (rp *Replicator) poll() (int, error) {
+	applied := atomic.LoadUint64(&rp.appliedSeq)
+	resp, err := rp.get(fmt.Sprintf("/changes?since=%d&limit=%d", applied, replicaBatch))
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusGone {
+			return 0, errResync
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var changes []Change
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return 0, err
+	}
+	for _, c := range changes {
+		if c.Seq != applied+1 {
+			return 0, errResync // Gap: the primary restarted (sequence numbers start over)
+		}
+		rp.store.apply(walRecord{Op: c.Op, Key: c.Key, Value: c.Value, ContentType: c.ContentType, Expires: c.Expires})
+		applied = c.Seq
+		atomic.StoreUint64(&rp.appliedSeq, applied)
+	}
+	if last, err := strconv.ParseUint(resp.Header.Get(HeaderLastSeq), 10, 64); err == nil {
+		if last < applied {
+			return 0, errResync // The primary restarted
+		}
+		atomic.StoreUint64(&rp.primarySeq, last)
+	}
+	atomic.StoreInt64(&rp.lastSync, time.Now().UnixNano())
+	return len(changes), nil
+}
+
+// get does a GET request to the primary. Error responses are returned as errors
+// (along with the response, whose body is closed).
+func (rp *Replicator) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rp.primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if user, pass, ok := strings.Cut(rp.basicAuth, ":"); ok {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := rp.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return resp, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Stats returns the state of the replication.
+func (rp *Replicator) Stats() ReplicationStats {
+	st := ReplicationStats{
+		Primary:    rp.primary,
+		AppliedSeq: atomic.LoadUint64(&rp.appliedSeq),
+		PrimarySeq: atomic.LoadUint64(&rp.primarySeq),
+	}
+	if st.PrimarySeq > st.AppliedSeq {
+		st.Lag = st.PrimarySeq - st.AppliedSeq
+	}
+	if ns := atomic.LoadInt64(&rp.lastSync); ns != 0 {
+		st.LastSync = time.Unix(0, ns)
+	}
+	return st
+}
+
+// SetPrimary makes s a read replica of the primary at the base URL primary, replicated by rp:
+// mutating requests (PUT, POST, PATCH and DELETE) are proxied to the primary,
+// reads are served from the replicated store (so they may be slightly stale).
+// It must be called before s is used.
+func (s *Server) SetPrimary(primary string, rp *Replicator) error {
+	u, err := url.Parse(primary)
+	if err != nil {
+		return err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Failed to proxy %s %s to primary %s: %v", r.Method, r.URL.Path, primary, err)
+		writeError(w, http.StatusBadGateway, CodePeerUnavailable, "Primary is unavailable!")
+	}
+	s.primary, s.replicator = proxy, rp
+	return nil
+}
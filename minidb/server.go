@@ -0,0 +1,1646 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is the HTTP handler of the minidb application, serving the endpoints
+// of a Store.
+type Server struct {
+	store *Store         // The store being served
+	mux   *http.ServeMux // Multiplexer of the endpoints
+	h     http.Handler   // Handler of all requests: mux wrapped in middlewares
+
+	inFlight int64     // Number of requests being served, must be accessed atomically
+	active   int64     // Number of requests actively processed (not waiting), must be accessed atomically
+	metrics  *metrics  // Metrics exposed at /metrics
+	vars     debugVars // Counters exposed at /debug/vars (if enabled)
+
+	closing   chan struct{} // Closed when the server is shutting down, to end streams
+	closeOnce sync.Once
+	notReady  int32 // 1 if the server is shutting down (not ready for traffic), must be accessed atomically
+	readOnly  int32 // 1 if mutations are rejected, must be accessed atomically
+
+	ring        *Ring                             // Hash ring of the cluster, nil if not in a cluster
+	self        string                            // Base URL of this node in the cluster
+	peerSecret  string                            // Secret shared by the nodes of the cluster
+	peerProxies map[string]*httputil.ReverseProxy // Proxies to the other nodes by base URL
+
+	primary    *httputil.ReverseProxy // Proxy to the primary, nil if not a read replica
+	replicator *Replicator            // Replicator of the store from the primary (if a read replica)
+
+	MaxKeyLength  int   // Maximum length of keys (in bytes)
+	MaxValueSize  int64 // Maximum size of values (in bytes)
+	MaxBulkKeys   int   // Maximum number of keys in bulk get requests
+	MaxImportSize int64 // Maximum size of import bodies (in bytes)
+
+	// BodyTimeout is the max time to receive request bodies (values), so slow clients
+	// trickling their bodies can't hold up writes. 0 means no limit (apart from the
+	// read timeout of the HTTP server).
+	BodyTimeout time.Duration
+
+	// ReserveTimeout is the max time reservations wait for locks (the timeout parameter
+	// of reservations may only shorten it). If positive, reservation responses get their own
+	// write deadline covering the wait, so a short write timeout of the HTTP server doesn't
+	// cut waits short. 0 means no limit (apart from the write timeout of the HTTP server).
+	ReserveTimeout time.Duration
+
+	// BasicAuth is the basic auth credentials required by the endpoints,
+	// in the form "user:pass". If empty, no authentication is required.
+	BasicAuth string
+
+	// Gzip tells if responses of at least GzipMinSize bytes are compressed with gzip
+	// (for clients accepting it).
+	Gzip        bool
+	GzipMinSize int
+
+	// CORSOrigins are the origins allowed to make cross-origin requests,
+	// "*" allows any origin. If empty, CORS headers are not sent.
+	CORSOrigins []string
+
+	// MaxInFlight is the maximum number of requests processed concurrently
+	// (not counting requests waiting for locks or changes), 0 means no limit.
+	MaxInFlight int
+
+	// RateLimiter limits the rate of requests per client, nil means no limit.
+	RateLimiter *RateLimiter
+
+	// Idempotency records the responses of requests with an Idempotency-Key header
+	// to replay them to retries, nil means idempotency keys are ignored.
+	Idempotency *IdempotencyCache
+
+	// Audit records the mutating requests, nil means no audit log.
+	Audit *AuditLog
+
+	// JSONValues tells if values sent with "Content-Type: application/json" are validated
+	// (and their content type is recorded, returned when they are read).
+	JSONValues bool
+
+	// AdminToken is the bearer token required by the admin endpoints.
+	// If empty, the admin endpoints are disabled (all requests are unauthorized).
+	AdminToken string
+}
+
+// NewServer creates a new Server serving store.
+func NewServer(store *Store) *Server {
+	s := &Server{
+		store:         store,
+		mux:           http.NewServeMux(),
+		metrics:       newMetrics(),
+		closing:       make(chan struct{}),
+		MaxKeyLength:  MaxKeyLength,
+		MaxValueSize:  MaxValueSize,
+		MaxBulkKeys:   MaxBulkKeys,
+		MaxImportSize: MaxImportSize,
+		Gzip:          true,
+		GzipMinSize:   GzipMinSize,
+	}
+
+	s.mux.HandleFunc(PathReservations, s.reservationsHandler)
+	s.mux.HandleFunc(PathMultiReserve, s.byQueryKey(PathReservations, s.reservationsHandler, noDryRun(s.multiReservationsHandler)))
+	s.mux.HandleFunc(PathReleaseEach, noDryRun(s.releaseEachHandler))
+	s.mux.HandleFunc(PathValues, s.valuesHandler)
+	s.mux.HandleFunc(PathValueQuery, s.byQueryKey(PathValues, s.valuesHandler, nil))
+	s.mux.HandleFunc(PathBulk, noDryRun(s.bulkHandler))
+	s.mux.HandleFunc(PathBulkGet, s.bulkGetHandler)
+	s.mux.HandleFunc(PathAdminUnlock, noDryRun(s.adminUnlockHandler))
+	s.mux.HandleFunc(PathAdminFlush, noDryRun(s.adminFlushHandler))
+	s.mux.HandleFunc(PathAdminValues, noDryRun(s.adminValuesHandler))
+	s.mux.HandleFunc(PathReadOnly, noDryRun(s.adminReadOnlyHandler))
+	s.mux.HandleFunc(PathAdminAudit, s.adminAuditHandler)
+	s.mux.HandleFunc(PathAdminLocks, s.adminLocksHandler)
+	s.mux.HandleFunc(PathEvents, s.eventsHandler)
+	s.mux.HandleFunc(PathChanges, s.changesHandler)
+	s.mux.HandleFunc(PathExport, s.exportHandler)
+	s.mux.HandleFunc(PathImport, noDryRun(s.importHandler))
+	s.mux.HandleFunc(PathStats, s.statsHandler)
+	s.mux.HandleFunc(PathStatsHot, s.statsHotHandler)
+	s.mux.HandleFunc(PathMetrics, s.metricsHandler)
+	s.mux.HandleFunc(PathHealthz, s.healthzHandler)
+	s.mux.HandleFunc(PathReadyz, s.readyzHandler)
+	s.mux.HandleFunc(PathVersion, versionHandler)
+	s.mux.HandleFunc(PathBuckets, s.bucketsHandler)
+	s.mux.HandleFunc("/", s.bucketHandler) // Unknown endpoints are handled by notFoundHandler
+
+	s.h = recoverPanics(s.limitInFlight(s.rateLimit(s.cors(s.basicAuth(s.rejectWrites(s.route(s.compress(s.idempotent(s.mux)))))))))
+
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+
+	sw := &statusWriter{ResponseWriter: w}
+	s.h.ServeHTTP(sw, r)
+	s.metrics.observeRequest(r.Method, sw.Status())
+	s.audit(r, sw.Status())
+}
+
+// EnableDebug mounts the net/http/pprof profiling handlers under /debug/pprof/,
+// and the expvar handler at /debug/vars, publishing the counters of the server.
+// They expose internals, so they should only be enabled for diagnostics.
+func (s *Server) EnableDebug() {
+	s.publishDebugVars()
+	s.mux.Handle(PathDebugVars, expvar.Handler())
+	s.mux.HandleFunc(PathPprof, pprof.Index)
+	s.mux.HandleFunc(PathPprof+"cmdline", pprof.Cmdline)
+	s.mux.HandleFunc(PathPprof+"profile", pprof.Profile)
+	s.mux.HandleFunc(PathPprof+"symbol", pprof.Symbol)
+	s.mux.HandleFunc(PathPprof+"trace", pprof.Trace)
+}
+
+// CloseStreams ends the long-lived streams being served (e.g. /events),
+// so they don't hold up shutting down.
+func (s *Server) CloseStreams() {
+	s.closeOnce.Do(func() { close(s.closing) })
+}
+
+// SetNotReady marks the server not ready: /readyz reports 503 from now on,
+// so load balancers stop routing new requests to it. Called when shutting down.
+func (s *Server) SetNotReady() {
+	atomic.StoreInt32(&s.notReady, 1)
+}
+
+// SetReadOnly sets whether s is read-only: in read-only mode mutating requests are
+// rejected (see rejectWrites). It may be called any time, requests already past the check
+// are completed.
+func (s *Server) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&s.readOnly, v)
+}
+
+// ReadOnly tells if s is read-only.
+func (s *Server) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+// InFlight returns the number of requests currently being served.
+func (s *Server) InFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+// reservationsHandler is a request handler which handles the endpoint
+// mapped to /reservations/.
+//
+// Reservations wait for the lock in arrival order (FIFO), at most timeout={duration}
+// (408 Request Timeout after that). With wait=false they don't wait (409 Conflict if locked),
+// with ttl={duration} the lock is released automatically unless renewed in time.
+// With until={value} the lock is only acquired once the value equals {value}, with
+// if=absent only if the key doesn't exist (it's created, e.g. for leader election).
+// Responses include a fencing token ("fence"), strictly increasing with each acquired lock.
+// The X-Owner header tells the identity of the holder (shown to operators only).
+func (s *Server) reservationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		allowMethods(w, http.MethodPost, http.MethodOptions)
+		return
+	default:
+		methodNotAllowed(w, http.MethodPost, http.MethodOptions)
+		return
+	}
+
+	dry, ok := parseDryRun(w, r)
+	if !ok {
+		return
+	}
+
+	// 0: key, 1: lockId, 2: "renew"
+	parts, ok := pathParts(w, r, PathReservations)
+	if !ok {
+		return
+	}
+	if len(parts) == 3 && parts[2] == "renew" {
+		if dry {
+			rejectDryRun(w)
+			return
+		}
+		s.renewReservation(w, r, parts[0], parts[1])
+		return
+	}
+	key := strings.Join(parts, "/") // Slashes are reported by checkKey
+
+	// POST /reservations/{key}?timeout={duration}&wait={true, false}&ttl={duration}
+	if err := s.checkRequestKey(r, key); err != nil {
+		sendKeyError(w, err)
+		return
+	}
+	key = inBucket(r, key)
+	p, ok := parseReserveParams(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := s.reserveContext(w, r, p.timeout)
+	defer cancel()
+
+	until, hasUntil := r.URL.Query()["until"]
+	if hasUntil && !p.wait {
+		badRequest(w, "The until parameter can't be used with wait=false!")
+		return
+	}
+	// if=present is the default: only existing keys can be reserved
+	cond := r.URL.Query().Get("if")
+	if cond != "" && cond != "absent" && cond != "present" {
+		badRequest(w, "Invalid if parameter (must be 'absent' or 'present')!")
+		return
+	}
+	absent := cond == "absent"
+	if absent && hasUntil {
+		badRequest(w, "The until parameter can't be used with if=absent!")
+		return
+	}
+	owner, ok := parseOwner(w, r)
+	if !ok {
+		return
+	}
+	if dry {
+		var u *string
+		if hasUntil {
+			u = &until[0]
+		}
+		s.dryRunReserve(w, r, key, p, u, absent)
+		return
+	}
+
+	start := time.Now()
+	var value string
+	var l Lock
+	var err error
+	switch {
+	case absent:
+		// POST /reservations/{key}?if=absent
+		l, err = s.store.ReserveAbsent(key, p.ttl)
+	case hasUntil:
+		// POST /reservations/{key}?until={value}
+		value = until[0]
+		l, err = s.store.ReserveUntil(ctx, key, value, p.ttl)
+	default:
+		value, l, err = s.store.Reserve(ctx, key, p.wait, p.ttl)
+	}
+	if p.wait && !absent {
+		s.metrics.observeWait(time.Since(start))
+	}
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			s.vars.reservationTimeouts.Add(1)
+		}
+		sendStoreError(w, r, err)
+		return
+	}
+	s.vars.reservations.Add(1)
+	if owner != "" {
+		s.store.SetOwner(key, l.Id, owner) // Fails only if the lock is gone already
+	}
+	resp := map[string]interface{}{"lock_id": l.Id, "fence": l.Fence, "value": value}
+	if !l.Expires.IsZero() {
+		// Remaining time, so the client knows when to renew
+		resp["ttl_seconds"] = time.Until(l.Expires).Seconds()
+	}
+	sendJSON(w, resp)
+}
+
+// reserveParams are the query parameters of reservations.
+type reserveParams struct {
+	wait    bool          // Tells if the reservation should wait for the lock
+	timeout time.Duration // Max time to wait for the lock, zero value means wait forever
+	ttl     time.Duration // TTL of the lock, zero value means the lock never expires
+}
+
+// parseReserveParams parses the wait, timeout and ttl query parameters of reservations.
+// If a parameter is invalid, an error response is sent and false is returned.
+func parseReserveParams(w http.ResponseWriter, r *http.Request) (p reserveParams, ok bool) {
+	wait := r.URL.Query().Get("wait")
+	if wait != "" && wait != "true" && wait != "false" {
+		badRequest(w, "Invalid wait parameter (must be 'true' or 'false')!")
+		return p, false
+	}
+	p.wait = wait != "false"
+	var err error
+	if p.timeout, err = parseDuration(r, "timeout"); err != nil {
+		badRequest(w, err.Error())
+		return p, false
+	}
+	if p.ttl, err = parseDuration(r, "ttl"); err != nil {
+		badRequest(w, err.Error())
+		return p, false
+	}
+	return p, true
+}
+
+// reserveWriteMargin is the time given to send the response of a reservation
+// after waiting for the lock (see reserveContext).
+const reserveWriteMargin = 10 * time.Second
+
+// reserveContext returns the context of waiting for locks by the reservation r: it's done
+// after timeout (the timeout parameter of r, 0 if not given), which is capped at
+// s.ReserveTimeout (if positive).
+// If s.ReserveTimeout is positive, the write deadline of the response is also set to cover
+// the wait (plus reserveWriteMargin), so the waits are governed by s.ReserveTimeout
+// instead of the write timeout of the HTTP server.
+func (s *Server) reserveContext(w http.ResponseWriter, r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if s.ReserveTimeout > 0 && (timeout == 0 || timeout > s.ReserveTimeout) {
+		timeout = s.ReserveTimeout
+	}
+	if timeout == 0 {
+		return context.WithCancel(r.Context())
+	}
+	if s.ReserveTimeout > 0 {
+		// If not supported by w, the write timeout of the HTTP server remains in effect
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + reserveWriteMargin))
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// multiReservationsHandler is a request handler which handles the endpoint
+// mapped to /reservations, reserving or releasing multiple keys at once.
+//
+// POST reserves the keys of a JSON array all-or-nothing (see Store.ReserveAll),
+// returning the lock IDs mapped from key. DELETE releases the locks of a JSON object
+// mapping keys to lock IDs: atomically by default, each independently with atomic=false
+// (the same as POST /reservations/release).
+func (s *Server) multiReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		// POST /reservations?timeout={duration}&wait={true, false}&ttl={duration}
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		var keys []string
+		if err := json.Unmarshal([]byte(body), &keys); err != nil {
+			badRequest(w, "Body must be a JSON array of keys!")
+			return
+		}
+		if len(keys) > s.MaxBulkKeys {
+			badRequest(w, fmt.Sprintf("Too many keys (max %d)!", s.MaxBulkKeys))
+			return
+		}
+		for _, key := range keys {
+			if err := s.checkKey(key); err != nil {
+				writeError(w, http.StatusBadRequest, keyErrorCode(err), fmt.Sprintf("%v (key: %q)", err, key))
+				return
+			}
+		}
+		p, ok := parseReserveParams(w, r)
+		if !ok {
+			return
+		}
+		owner, ok := parseOwner(w, r)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := s.reserveContext(w, r, p.timeout)
+		defer cancel()
+
+		start := time.Now()
+		locks, err := s.store.ReserveAll(ctx, keys, p.wait, p.ttl)
+		if p.wait {
+			s.metrics.observeWait(time.Since(start))
+		}
+		if err != nil {
+			if err == context.DeadlineExceeded {
+				s.vars.reservationTimeouts.Add(1)
+			}
+			sendStoreError(w, r, err)
+			return
+		}
+		s.vars.reservations.Add(int64(len(locks)))
+		lockIds := make(map[string]string, len(locks))
+		for key, l := range locks {
+			lockIds[key] = l.Id
+			if owner != "" {
+				s.store.SetOwner(key, l.Id, owner)
+			}
+		}
+		sendJSON(w, lockIds)
+	case http.MethodDelete:
+		// DELETE /reservations?atomic={true, false}
+		atomicRelease := r.URL.Query().Get("atomic")
+		if atomicRelease != "" && atomicRelease != "true" && atomicRelease != "false" {
+			badRequest(w, "Invalid atomic parameter (must be 'true' or 'false')!")
+			return
+		}
+		lockIds, ok := s.readLockIds(w, r)
+		if !ok {
+			return
+		}
+		if atomicRelease == "false" {
+			s.releaseEach(w, lockIds)
+			return
+		}
+		for _, lockId := range lockIds {
+			if !validateLockId(w, lockId) {
+				return
+			}
+		}
+		if err := s.store.ReleaseAll(lockIds); err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// readLockIds reads the request body which is a JSON object mapping keys to lock IDs,
+// of at most s.MaxBulkKeys keys.
+// If reading the body fails, an error response is sent and false is returned.
+func (s *Server) readLockIds(w http.ResponseWriter, r *http.Request) (map[string]string, bool) {
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return nil, false
+	}
+	var lockIds map[string]string
+	if err := json.Unmarshal([]byte(body), &lockIds); err != nil {
+		badRequest(w, "Body must be a JSON object mapping keys to lock IDs!")
+		return nil, false
+	}
+	if len(lockIds) > s.MaxBulkKeys {
+		badRequest(w, fmt.Sprintf("Too many keys (max %d)!", s.MaxBulkKeys))
+		return nil, false
+	}
+	return lockIds, true
+}
+
+// releaseEachHandler is a request handler which handles the endpoint
+// mapped to /reservations/release, releasing the locks of a JSON object mapping
+// keys to lock IDs each independently (see releaseEach).
+// It shadows the key "release" of /reservations/, which can be reserved as
+// /reservations?key=release.
+func (s *Server) releaseEachHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	// POST /reservations/release
+	lockIds, ok := s.readLockIds(w, r)
+	if !ok {
+		return
+	}
+	s.releaseEach(w, lockIds)
+}
+
+// Results of the releases of releaseEach.
+const (
+	ReleaseReleased  = "released"   // Lock released
+	ReleaseWrongLock = "wrong_lock" // Lock id does not identify the currently held lock
+	ReleaseNotFound  = "not_found"  // Key doesn't exist
+)
+
+// releaseEach handles releasing multiple locks (given as lock ids mapped from key)
+// independently, sending the result per key.
+func (s *Server) releaseEach(w http.ResponseWriter, lockIds map[string]string) {
+	results := make(map[string]string, len(lockIds))
+	valid := make(map[string]string, len(lockIds))
+	for key, lockId := range lockIds {
+		if wellFormedLockId(lockId) {
+			valid[key] = lockId
+		} else {
+			results[key] = ReleaseWrongLock // Can't identify any lock
+		}
+	}
+	errs := s.store.ReleaseEach(valid)
+	released := 0
+	for key := range valid {
+		switch errs[key] {
+		case nil:
+			results[key] = ReleaseReleased
+			released++
+		case ErrNotFound:
+			results[key] = ReleaseNotFound
+		default:
+			results[key] = ReleaseWrongLock
+		}
+	}
+	sendJSON(w, map[string]interface{}{"results": results, "released": released, "failed": len(lockIds) - released})
+}
+
+// renewReservation handles the lock renewal endpoint, resetting the expiry
+// of the lock identified by lockId. An already expired lock gets 409 Conflict.
+func (s *Server) renewReservation(w http.ResponseWriter, r *http.Request, key, lockId string) {
+	// POST /reservations/{key}/{lock_id}/renew?ttl={duration}
+	if err := s.checkKey(key); err != nil {
+		sendKeyError(w, err)
+		return
+	}
+	key = inBucket(r, key)
+	ttl, err := parseDuration(r, "ttl")
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	if ttl == 0 {
+		badRequest(w, "Missing ttl parameter!")
+		return
+	}
+	if !validateLockId(w, lockId) {
+		return
+	}
+
+	if err := s.store.Renew(key, lockId, ttl); err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// valuesHandler is a request handler which handles the endpoints
+// mapped to /values/.
+//
+// Reads (GET, HEAD and meta) don't touch the lock, and send the ETag of the value,
+// honoring If-None-Match. GET with raw=true sends the value as is instead of JSON.
+// PUT returns 201 Created if it created the key; it may be conditional: expect={value}
+// (compare-and-swap) or If-Match, and may set a TTL with ttl={duration}.
+// Mutating requests accept dry_run=true (see dryRunValues).
+func (s *Server) valuesHandler(w http.ResponseWriter, r *http.Request) {
+	allowed := []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+	if r.Method == http.MethodOptions {
+		allowMethods(w, allowed...)
+		return
+	}
+
+	// 0: key, 1: lockId (POST, DELETE) or sub-resource
+	parts, ok := pathParts(w, r, PathValues)
+	if !ok {
+		return
+	}
+	key := parts[0] // If there is no key, this will be empty string
+	if err := s.checkRequestKey(r, key); err != nil {
+		sendKeyError(w, err)
+		return
+	}
+	key = inBucket(r, key)
+
+	if isMutating(r.Method) {
+		if dry, ok := parseDryRun(w, r); !ok {
+			return
+		} else if dry {
+			s.dryRunValues(w, r, key, parts)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if len(parts) == 2 && parts[1] == "meta" {
+			// GET /values/{key}/meta
+			meta, ok := s.store.Meta(key)
+			if !ok {
+				sendStoreError(w, r, ErrNotFound)
+				return
+			}
+			sendJSON(w, meta)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "watch" {
+			s.watch(w, r, key)
+			return
+		}
+		// GET /values/{key}?raw={true, false}
+		// Read-only: does not touch the value's lock, so it never waits.
+		raw, ok := parseRaw(w, r)
+		if !ok {
+			return
+		}
+		value, contentType, err := s.store.GetTyped(key)
+		if err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		etag := ETag(value)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if raw {
+			sendRaw(w, value, contentType)
+			return
+		}
+		resp := map[string]interface{}{"value": value}
+		if value == "" {
+			resp["empty"] = true // Exists, but its value is empty (absent keys are 404)
+		}
+		if contentType != "" {
+			resp["content_type"] = contentType
+		}
+		sendJSON(w, resp)
+	case http.MethodHead:
+		// HEAD /values/{key}?raw={true, false}
+		// Cheap existence check: no body, Content-Length (and Content-Type if known)
+		// describe the value (as GET would send it in raw mode).
+		raw, ok := parseRaw(w, r)
+		if !ok {
+			return
+		}
+		value, contentType, err := s.store.GetTyped(key)
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		etag := ETag(value)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if contentType == "" && raw {
+			contentType = rawContentType
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		if len(parts) == 2 && parts[1] == "incr" {
+			s.incr(w, r, key)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "append" {
+			s.append(w, r, key)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "copy" {
+			s.copy(w, r, key)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "rename" {
+			s.rename(w, r, key)
+			return
+		}
+		// POST /values/{key}/{lock_id}?release={true, false}
+		u, ok := s.parseUpdate(w, r, parts)
+		if !ok {
+			return
+		}
+		if err := s.store.Update(key, u.lockId, u.value, u.contentType, u.release); err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		// PUT /values/{key}?expect={value}&ttl={duration}
+		u, ok := s.parsePut(w, r)
+		if !ok {
+			return
+		}
+		value := u.value
+		var l Lock
+		var created bool // PutIf and PutIfMatch only set existing keys
+		var err error
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			l, err = s.store.PutIfMatch(r.Context(), key, value, u.contentType, parseETags(ifMatch), u.ttl)
+		} else if expect, ok := r.URL.Query()["expect"]; ok {
+			l, err = s.store.PutIf(r.Context(), key, value, u.contentType, expect[0], u.ttl)
+		} else {
+			l, created, err = s.store.Put(r.Context(), key, value, u.contentType, u.ttl)
+		}
+		if err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		s.vars.puts.Add(1)
+		w.Header().Set("ETag", ETag(value))
+		if created {
+			w.Header().Set("Location", requestPath(r))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+		}
+		sendJSON(w, map[string]interface{}{"lock_id": l.Id, "fence": l.Fence})
+	case http.MethodPatch:
+		s.patch(w, r, key, parts, false)
+	case http.MethodDelete:
+		var err error
+		if expect, ok := r.URL.Query()["expect"]; ok && len(parts) == 1 {
+			// DELETE /values/{key}?expect={value}
+			err = s.store.DeleteIf(r.Context(), key, expect[0])
+		} else {
+			// DELETE /values/{key}/{lock_id}
+			lockId, ok := parseDeleteLockId(w, parts)
+			if !ok {
+				return
+			}
+			err = s.store.Delete(key, lockId)
+		}
+		if err != nil {
+			sendStoreError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, allowed...)
+	}
+}
+
+// valueWrite is a write of a value parsed from a PUT or POST request of /values/{key}.
+type valueWrite struct {
+	value       string        // New value
+	contentType string        // Content type of the new value (may be empty)
+	ttl         time.Duration // Time to live of the value (PUT), 0 if it never expires
+	lockId      string        // Lock id of the key (POST)
+	release     bool          // Tells if the lock is to be released (POST)
+}
+
+// parsePut parses the value write of a PUT request of /values/{key}.
+// It's shared by real requests and dry runs, so they are validated the same way.
+// If it's invalid, an error response is sent and ok is false.
+func (s *Server) parsePut(w http.ResponseWriter, r *http.Request) (u valueWrite, ok bool) {
+	var err error
+	if u.ttl, err = parseDuration(r, "ttl"); err != nil {
+		badRequest(w, err.Error())
+		return u, false
+	}
+	if u.value, ok = s.readBody(w, r); !ok {
+		return u, false
+	}
+	u.contentType, ok = s.valueContentType(w, r, u.value)
+	return u, ok
+}
+
+// parseUpdate parses the value write of a POST request of /values/{key}/{lock_id}
+// (parts are the path parts like in valuesHandler).
+// It's shared by real requests and dry runs, so they are validated the same way.
+// If it's invalid, an error response is sent and ok is false.
+func (s *Server) parseUpdate(w http.ResponseWriter, r *http.Request, parts []string) (u valueWrite, ok bool) {
+	if u.value, ok = s.readBody(w, r); !ok {
+		return u, false
+	}
+	release := r.URL.Query().Get("release")
+	// According to spec, if release is neither "true" nor "false", nothing should be set
+	if len(parts) < 2 || (release != "false" && release != "true") {
+		badRequest(w, "Missing lockId and/or release parameter (must be 'true' or 'false')!")
+		return u, false
+	}
+	if !validateLockId(w, parts[1]) {
+		return u, false
+	}
+	u.lockId, u.release = parts[1], release == "true"
+	u.contentType, ok = s.valueContentType(w, r, u.value)
+	return u, ok
+}
+
+// parseDeleteLockId parses the lock id of a DELETE request of /values/{key}/{lock_id}
+// (parts are the path parts like in valuesHandler).
+// If it's missing or invalid, an error response is sent and ok is false.
+func parseDeleteLockId(w http.ResponseWriter, parts []string) (lockId string, ok bool) {
+	if len(parts) < 2 {
+		badRequest(w, "Missing lockId!")
+		return "", false
+	}
+	if !validateLockId(w, parts[1]) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// watch handles the long-poll watch endpoint, waiting for the value of key to change:
+// until its version differs from since (0 returns right away), else 304 Not Modified.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, key string) {
+	// GET /values/{key}/watch?since={version}&timeout={duration}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			badRequest(w, "Invalid since parameter (must be a non-negative integer)!")
+			return
+		}
+	}
+	timeout, err := parseDuration(r, "timeout")
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	if timeout == 0 {
+		timeout = WatchTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	value, version, err := s.store.Watch(ctx, key, since)
+	if err == context.DeadlineExceeded && r.Context().Err() == nil {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	sendJSON(w, map[string]interface{}{"value": value, "version": version})
+}
+
+// incr handles the atomic counter endpoint, adding to the integer value of key.
+func (s *Server) incr(w http.ResponseWriter, r *http.Request, key string) {
+	// POST /values/{key}/incr?by={n}
+	by := int64(1)
+	if v := r.URL.Query().Get("by"); v != "" {
+		var err error
+		if by, err = strconv.ParseInt(v, 10, 64); err != nil {
+			badRequest(w, "Invalid by parameter (must be an integer)!")
+			return
+		}
+	}
+
+	n, err := s.store.Incr(r.Context(), key, by)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	sendJSON(w, map[string]int64{"value": n})
+}
+
+// append handles appending the request body to the value of key.
+func (s *Server) append(w http.ResponseWriter, r *http.Request, key string) {
+	// POST /values/{key}/append
+	data, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := s.store.Append(r.Context(), key, data, s.MaxValueSize)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	sendJSON(w, map[string]int{"length": n})
+}
+
+// copy handles copying the value of key to another key, acquiring the lock of the latter.
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, key string) {
+	// POST /values/{key}/copy?to={dest}
+	to := r.URL.Query().Get("to")
+	if err := s.checkKey(to); err != nil {
+		writeError(w, http.StatusBadRequest, keyErrorCode(err), fmt.Sprintf("%v (to: %q)", err, to))
+		return
+	}
+	to = inBucket(r, to) // Same bucket as key
+
+	l, err := s.store.Copy(key, to)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	sendJSON(w, map[string]interface{}{"lock_id": l.Id, "fence": l.Fence})
+}
+
+// rename handles moving the value of key to another key. An existing destination
+// is only overwritten with overwrite=true.
+func (s *Server) rename(w http.ResponseWriter, r *http.Request, key string) {
+	// POST /values/{key}/rename?to={dest}&overwrite={true, false}
+	to := r.URL.Query().Get("to")
+	if err := s.checkKey(to); err != nil {
+		writeError(w, http.StatusBadRequest, keyErrorCode(err), fmt.Sprintf("%v (to: %q)", err, to))
+		return
+	}
+	to = inBucket(r, to) // Same bucket as key
+	overwrite := r.URL.Query().Get("overwrite")
+	if overwrite != "" && overwrite != "true" && overwrite != "false" {
+		badRequest(w, "Invalid overwrite parameter (must be 'true' or 'false')!")
+		return
+	}
+
+	if err := s.store.Rename(key, to, overwrite == "true"); err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bulkHandler is a request handler which handles the endpoint
+// mapped to /bulk, setting the keys of a JSON object all-or-nothing (see Store.PutAll).
+func (s *Server) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, http.MethodPut)
+		return
+	}
+
+	// PUT /bulk
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(body), &values); err != nil {
+		badRequest(w, "Body must be a JSON object mapping keys to values!")
+		return
+	}
+	// All or nothing: check all keys first
+	for key := range values {
+		if err := s.checkKey(key); err != nil {
+			writeError(w, http.StatusBadRequest, keyErrorCode(err), fmt.Sprintf("%v (key: %q)", err, key))
+			return
+		}
+	}
+
+	locks, err := s.store.PutAll(values)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	lockIds := make(map[string]string, len(locks))
+	for key, l := range locks {
+		lockIds[key] = l.Id
+	}
+	sendJSON(w, lockIds)
+}
+
+// bulkGetHandler is a request handler which handles the endpoint
+// mapped to /bulk/get, returning the values of the keys of a JSON array
+// (missing keys are omitted) without touching their locks.
+func (s *Server) bulkGetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	// POST /bulk/get
+	body, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	var keys []string
+	if err := json.Unmarshal([]byte(body), &keys); err != nil {
+		badRequest(w, "Body must be a JSON array of keys!")
+		return
+	}
+	if len(keys) > s.MaxBulkKeys {
+		badRequest(w, fmt.Sprintf("Too many keys (max %d)!", s.MaxBulkKeys))
+		return
+	}
+
+	values, err := s.store.GetAll(keys)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	sendJSON(w, values)
+}
+
+// adminUnlockHandler is a request handler which handles the endpoint
+// mapped to /admin/unlock/, releasing the lock of a key regardless of who holds it
+// (for locks of dead clients).
+func (s *Server) adminUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	// POST /admin/unlock/{key}
+	parts, ok := pathParts(w, r, PathAdminUnlock)
+	if !ok {
+		return
+	}
+	key := strings.Join(parts, "/") // Slashes are reported by checkKey
+	if err := s.checkKey(key); err != nil {
+		sendKeyError(w, err)
+		return
+	}
+
+	locked, err := s.store.ForceUnlock(key)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	log.Printf("Admin force-unlocked key %q (was locked: %t), requested by %s", key, locked, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminFlushHandler is a request handler which handles the endpoint
+// mapped to /admin/flush, deleting all keys.
+func (s *Server) adminFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	// POST /admin/flush
+	n, err := s.store.Flush()
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	log.Printf("Admin flushed the store, deleted %d keys, requested by %s", n, r.RemoteAddr)
+	sendJSON(w, map[string]int{"deleted": n})
+}
+
+// adminValuesHandler is a request handler which handles the endpoint
+// mapped to /admin/values, deleting keys by prefix.
+func (s *Server) adminValuesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	// DELETE /admin/values?prefix={prefix}
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		badRequest(w, "Missing prefix parameter (use /admin/flush to delete all keys)!")
+		return
+	}
+	deleted, skipped, err := s.store.DeletePrefix(prefix)
+	if err != nil {
+		sendStoreError(w, r, err)
+		return
+	}
+	log.Printf("Admin deleted %d keys with prefix %q (skipped %d locked keys), requested by %s", deleted, prefix, skipped, r.RemoteAddr)
+	sendJSON(w, map[string]int{"deleted": deleted, "skipped": skipped})
+}
+
+// adminReadOnlyHandler is a request handler which handles the endpoint
+// mapped to /admin/readonly, switching read-only mode on or off at runtime.
+func (s *Server) adminReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		// POST /admin/readonly?enabled={true, false}
+		enabled := r.URL.Query().Get("enabled")
+		if enabled != "true" && enabled != "false" {
+			badRequest(w, "Invalid enabled parameter (must be 'true' or 'false')!")
+			return
+		}
+		// Requests already past the check (see rejectWrites) are completed
+		s.SetReadOnly(enabled == "true")
+		log.Printf("Admin set read-only mode to %s, requested by %s", enabled, r.RemoteAddr)
+	}
+	// GET /admin/readonly
+	sendJSON(w, map[string]interface{}{"read_only": s.ReadOnly()})
+}
+
+// checkAdmin checks if the request carries the admin bearer token.
+// If not, it sends a 401 Unauthorized response and returns false.
+func (s *Server) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid admin token!")
+		return false
+	}
+	return true
+}
+
+// statsHandler is a request handler which handles the endpoint
+// mapped to /stats (see Stats), including the state of the replication on replicas.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	stats := s.store.Stats()
+	if s.replicator != nil {
+		rs := s.replicator.Stats()
+		stats.Replication = &rs
+	}
+	sendJSON(w, stats)
+}
+
+// metricsHandler is a request handler which handles the endpoint
+// mapped to /metrics, exposing metrics in the Prometheus text format.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w, s.store.Stats())
+}
+
+// healthzHandler is a request handler which handles the endpoint
+// mapped to /healthz, the liveness probe.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	if !s.store.Healthy(HealthTimeout) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "unavailable"})
+		return
+	}
+	sendJSON(w, map[string]string{"status": "ok"})
+}
+
+// readyzHandler is a request handler which handles the endpoint
+// mapped to /readyz, the readiness probe.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	if atomic.LoadInt32(&s.notReady) != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "shutting down"})
+		return
+	}
+	sendJSON(w, map[string]string{"status": "ready"})
+}
+
+// versionHandler is a request handler which handles the endpoint
+// mapped to /version, returning the build info.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	sendJSON(w, map[string]string{"version": version, "commit": commit, "date": date})
+}
+
+// rawContentType is the content type of raw values having no content type.
+const rawContentType = "application/octet-stream"
+
+// rawChunkSize is the size of the chunks raw values are sent in.
+const rawChunkSize = 32 << 10
+
+// parseRaw parses the raw query parameter, telling if the raw value is requested
+// instead of the JSON response. If it's invalid, sends a 400 Bad Request error response.
+func parseRaw(w http.ResponseWriter, r *http.Request) (raw, ok bool) {
+	switch r.URL.Query().Get("raw") {
+	case "", "false":
+		return false, true
+	case "true":
+		return true, true
+	}
+	badRequest(w, "Invalid raw parameter (must be 'true' or 'false')!")
+	return false, false
+}
+
+// sendRaw sends value as is (not wrapped in JSON) with the given content type
+// (rawContentType if empty). The value is written in chunks, each flushed,
+// so large values are streamed instead of being buffered.
+func sendRaw(w http.ResponseWriter, value, contentType string) {
+	if contentType == "" {
+		contentType = rawContentType
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(value)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	for len(value) > 0 {
+		chunk := value
+		if len(chunk) > rawChunkSize {
+			chunk = chunk[:rawChunkSize]
+		}
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return // Client is gone
+		}
+		rc.Flush()
+		value = value[len(chunk):]
+	}
+}
+
+// sendJSON sends v as a JSON response.
+func sendJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	if jsonStyle == JSONStyleCamel {
+		v = camelJSON(reflect.ValueOf(v))
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Machine-readable codes of error responses.
+const (
+	CodeBadRequest          = "bad_request"          // Invalid request (e.g. parameters or body)
+	CodeKeyMissing          = "key_missing"          // Key is missing from the request
+	CodeKeyInvalid          = "key_invalid"          // Key is not valid
+	CodeKeyTooLong          = "key_too_long"         // Key is longer than allowed
+	CodeMalformedLockId     = "malformed_lock_id"    // Lock id doesn't have the format of lock ids
+	CodeNotFound            = "not_found"            // Key (or endpoint) doesn't exist
+	CodeUnauthorized        = "unauthorized"         // Lock id (or admin token) is not valid
+	CodeLocked              = "locked"               // Key is locked
+	CodeExpired             = "expired"              // Lock has expired
+	CodeMismatch            = "mismatch"             // Value doesn't match the expected value
+	CodeIdempotencyMismatch = "idempotency_mismatch" // Idempotency key is reused with a different request body
+	CodeExists              = "exists"               // Key already exists
+	CodeNotInteger          = "not_integer"          // Value is not an integer
+	CodeInvalidJSON         = "invalid_json"         // Value sent as JSON is not well-formed JSON
+	CodeInvalidPatch        = "invalid_patch"        // Patch is malformed, can't be applied, or the value is not JSON
+	CodePrecondition        = "precondition_failed"  // ETag of the value doesn't match (If-Match)
+	CodeTimeout             = "timeout"              // Lock couldn't be acquired in time
+	CodeTooLarge            = "too_large"            // Request body is too large
+	CodeInsufficientStorage = "insufficient_storage" // Memory budget of the store would be exceeded
+	CodeUnsupportedEncoding = "unsupported_encoding" // Content-Encoding of the request body is not supported
+	CodeRateLimited         = "rate_limited"         // Client exceeded the rate limit
+	CodeOverloaded          = "overloaded"           // Too many requests are being processed
+	CodeReadOnly            = "read_only"            // Server is in read-only mode, mutations are rejected
+	CodeQueueFull           = "queue_full"           // Too many requests are waiting for the lock of the key
+	CodeResyncRequired      = "resync_required"      // Requested changes are not kept anymore
+	CodeMethodNotAllowed    = "method_not_allowed"   // Method is not supported by the endpoint
+	CodePeerUnavailable     = "peer_unavailable"     // Peer owning the key can't be reached
+	CodeInternal            = "internal"             // Internal server error
+)
+
+// writeError sends a JSON error response with the given status code
+// in the form {"error": {"code": code, "message": msg}}.
+func writeError(w http.ResponseWriter, status int, code, msg string) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": code, "message": msg},
+	})
+}
+
+// badRequest sends a 400 Bad Request error response with the given message.
+func badRequest(w http.ResponseWriter, msg string) {
+	writeError(w, http.StatusBadRequest, CodeBadRequest, msg)
+}
+
+// sendKeyError sends the 400 Bad Request error response of err returned by checkKey.
+func sendKeyError(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, keyErrorCode(err), err.Error())
+}
+
+// keyErrorCode returns the error code of err returned by checkKey.
+func keyErrorCode(err error) string {
+	switch err {
+	case ErrKeyMissing:
+		return CodeKeyMissing
+	case ErrKeyTooLong:
+		return CodeKeyTooLong
+	}
+	return CodeKeyInvalid
+}
+
+// notFoundHandler is a request handler which handles requests of unknown endpoints.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, CodeNotFound, "Unknown endpoint!")
+}
+
+// allowMethods responds to an OPTIONS request with 204 No Content,
+// listing the allowed methods in the Allow header.
+func allowMethods(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// methodNotAllowed sends a 405 Method Not Allowed response,
+// listing the allowed methods in the Allow header.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed!")
+}
+
+// sendStoreError sends the error response corresponding to err returned by a Store method.
+func sendStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		// Client went away, nobody to respond to
+		return
+	}
+
+	if pe, ok := err.(*PatchError); ok {
+		writeError(w, http.StatusBadRequest, CodeInvalidPatch, pe.Error())
+		return
+	}
+
+	switch err {
+	case ErrNotFound:
+		writeError(w, http.StatusNotFound, CodeNotFound, err.Error())
+	case ErrUnauthorized:
+		writeError(w, http.StatusUnauthorized, CodeUnauthorized, err.Error())
+	case ErrLocked:
+		writeError(w, http.StatusConflict, CodeLocked, err.Error())
+	case ErrExpired:
+		writeError(w, http.StatusConflict, CodeExpired, err.Error())
+	case ErrMismatch:
+		writeError(w, http.StatusConflict, CodeMismatch, err.Error())
+	case ErrNotInteger:
+		writeError(w, http.StatusBadRequest, CodeNotInteger, err.Error())
+	case ErrQueueFull:
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, CodeQueueFull, err.Error())
+	case ErrTooLarge:
+		writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, err.Error())
+	case ErrInsufficientStorage:
+		writeError(w, http.StatusInsufficientStorage, CodeInsufficientStorage, err.Error())
+	case ErrExists:
+		writeError(w, http.StatusConflict, CodeExists, err.Error())
+	case ErrPrecondition:
+		writeError(w, http.StatusPreconditionFailed, CodePrecondition, err.Error())
+	case context.DeadlineExceeded:
+		writeError(w, http.StatusRequestTimeout, CodeTimeout, "Timed out waiting for the lock!")
+	default:
+		log.Println("Unexpected store error:", err)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Internal server error!")
+	}
+}
+
+// validateLockId checks if the presented lockId has the format of the generated lock ids
+// (so it's not compared to the lock at all if it can't be valid).
+// If not, a 400 Bad Request response is sent and false is returned.
+func validateLockId(w http.ResponseWriter, lockId string) bool {
+	if !wellFormedLockId(lockId) {
+		writeError(w, http.StatusBadRequest, CodeMalformedLockId, "Malformed lock id!")
+		return false
+	}
+	return true
+}
+
+const (
+	HeaderOwner = "X-Owner" // Header of the owner of reservations (informational only)
+	maxOwnerLen = 128       // Max length of owners
+)
+
+// parseOwner returns the owner of a reservation given in the X-Owner header (if any).
+// If it's invalid, an error response is sent and false is returned.
+func parseOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := r.Header.Get(HeaderOwner)
+	if len(owner) > maxOwnerLen {
+		badRequest(w, fmt.Sprintf("Invalid %s header (must be at most %d characters)!", HeaderOwner, maxOwnerLen))
+		return "", false
+	}
+	for i := 0; i < len(owner); i++ {
+		if owner[i] < ' ' || owner[i] > '~' {
+			// Printable ASCII only, it's logged and shown to operators
+			badRequest(w, fmt.Sprintf("Invalid %s header (must be printable ASCII)!", HeaderOwner))
+			return "", false
+		}
+	}
+	return owner, true
+}
+
+// parseETags parses the comma separated list of entity tags of an If-Match
+// (or If-None-Match) header.
+func parseETags(header string) []string {
+	tags := strings.Split(header, ",")
+	for i, t := range tags {
+		tags[i] = strings.TrimSpace(t)
+	}
+	return tags
+}
+
+// etagMatches tells if etag is listed in the If-None-Match header ("*" matches any).
+// An empty header matches nothing.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, t := range parseETags(header) {
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDuration parses the optional duration query parameter name,
+// which must be positive if present.
+// Returns zero if the parameter is absent.
+func parseDuration(r *http.Request, name string) (time.Duration, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid %s parameter (must be a positive duration, e.g. '5s')!", name)
+	}
+	return d, nil
+}
+
+// readBody reads the request body which is the new value.
+// Bodies with "Content-Encoding: gzip" are decompressed.
+// The size of the body is limited to s.MaxValueSize (the decompressed size if compressed,
+// so decompression bombs are stopped).
+// If reading the body fails, an error response is sent and false is returned.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return s.readBodyMax(w, r, s.MaxValueSize, "Value")
+}
+
+// readBodyMax is like readBody, but the size of the body is limited to max bytes.
+// what names the body in the error response if it's too large.
+func (s *Server) readBodyMax(w http.ResponseWriter, r *http.Request, max int64, what string) (string, bool) {
+	body := r.Body
+	var gz *gzip.Reader
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		var err error
+		if gz, err = gzip.NewReader(http.MaxBytesReader(w, r.Body, max)); err != nil {
+			badRequest(w, "Malformed gzip body!")
+			return "", false
+		}
+		body = gz
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedEncoding, fmt.Sprintf("Unsupported Content-Encoding: %q!", enc))
+		return "", false
+	}
+
+	if s.BodyTimeout > 0 {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(s.BodyTimeout)); err == nil {
+			defer rc.SetReadDeadline(time.Time{})
+		}
+	}
+
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, body, max))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, fmt.Sprintf("%s too large, max allowed size is %d bytes!", what, mbe.Limit))
+			return "", false
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			writeError(w, http.StatusRequestTimeout, CodeTimeout, "Timed out reading the request body!")
+			return "", false
+		}
+		if gz != nil {
+			badRequest(w, "Malformed gzip body!")
+			return "", false
+		}
+		log.Println("Error reading request body:", err)
+		badRequest(w, "Failed to read body!")
+		return "", false
+	}
+	return string(content), true
+}
+
+// valueContentType returns the content type to record for the value sent in r (may be empty).
+// If s.JSONValues is true, values sent with "Content-Type: application/json" must be well-formed
+// JSON, and their content type is recorded; other content types are not recorded.
+// If the value is invalid, an error response is sent and false is returned.
+func (s *Server) valueContentType(w http.ResponseWriter, r *http.Request, value string) (string, bool) {
+	if !s.JSONValues {
+		return "", true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return "", true // Passed through as is
+	}
+	if !json.Valid([]byte(value)) {
+		writeError(w, http.StatusBadRequest, CodeInvalidJSON, "Value is not well-formed JSON!")
+		return "", false
+	}
+	return mediaType, true
+}
+
+// keyOf returns the key of r by its path as stored (with its bucket, see inBucket),
+// or an empty string if the endpoint has no key (or the path is invalid).
+func keyOf(r *http.Request) string {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(part); err != nil {
+			return ""
+		}
+	}
+	switch {
+	case r.URL.Path == PathReleaseEach:
+		return "" // Multiple keys
+	case r.URL.Path == PathValueQuery || r.URL.Path == PathMultiReserve:
+		return r.URL.Query().Get("key") // Key given as a query parameter (if any)
+	case len(parts) >= 2 && (parts[0] == "values" || parts[0] == "reservations"):
+		return parts[1]
+	case len(parts) >= 3 && parts[0] == "admin" && parts[1] == "unlock":
+		return parts[2]
+	case len(parts) >= 3 && (parts[1] == "values" || parts[1] == "reservations"):
+		return parts[0] + "/" + parts[2] // Key of a bucket
+	}
+	return ""
+}
+
+// pathParts returns the segments of the path of r following prefix, each unescaped
+// (so e.g. "%20" stands for a space in keys). An escaped slash ("%2F") does not separate
+// segments, but it is part of the unescaped segment.
+// Since a path always has a segment after prefix, at least one (maybe empty) segment is returned.
+// If unescaping fails, an error response is sent and false is returned.
+func pathParts(w http.ResponseWriter, r *http.Request, prefix string) ([]string, bool) {
+	// Path length is at least len(prefix) else we wouldn't be here
+	parts := strings.Split(r.URL.EscapedPath()[len(prefix):], "/")
+	for i, part := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(part); err != nil {
+			badRequest(w, "Invalid escaping in path!")
+			return nil, false
+		}
+	}
+	return parts, true
+}
+
+var (
+	ErrKeyMissing = errors.New("Key is missing!")
+	ErrKeyInvalid = errors.New("Key must not contain '/'!")
+	ErrKeyTooLong = errors.New("Key is too long!")
+)
+
+// queryKeyKey is the context key telling that the key of a request is given in the key
+// query parameter (see byQueryKey).
+type queryKeyKey struct{}
+
+// byQueryKey returns a handler which serves the requests having a key query parameter with
+// keyHandler, the handler of the endpoint mapped to prefix (e.g. /values/), as if the key
+// was in the path. The lock id (if any) is taken from the lock_id query parameter.
+// Requests without a key parameter are served by next (keyHandler if nil, which reports
+// the missing key).
+//
+// Keys given in the query may contain slashes (see checkRequestKey), while keys in paths
+// can't, as they separate path segments. Keys without slashes refer to the same keys
+// in both, keys with slashes are stored apart from the keys of buckets (see inBucket).
+func (s *Server) byQueryKey(prefix string, keyHandler, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if _, ok := q["key"]; !ok && next != nil {
+			next(w, r)
+			return
+		}
+
+		// Escaped slashes ("%2F") don't separate path segments, see pathParts
+		path := prefix + url.PathEscape(q.Get("key"))
+		if lockId, ok := q["lock_id"]; ok {
+			path += "/" + url.PathEscape(lockId[0])
+		}
+		r2 := r.WithContext(context.WithValue(r.Context(), queryKeyKey{}, true))
+		u := *r.URL
+		u.RawPath = path
+		u.Path, _ = url.PathUnescape(path) // Escaped by us, can't fail
+		r2.URL = &u
+		keyHandler(w, r2)
+	}
+}
+
+// checkRequestKey checks key of r like checkKey, but keys given in the key query parameter
+// (see byQueryKey) may contain slashes.
+func (s *Server) checkRequestKey(r *http.Request, key string) error {
+	if queryKey, _ := r.Context().Value(queryKeyKey{}).(bool); !queryKey {
+		return s.checkKey(key)
+	}
+	switch {
+	case key == "":
+		return ErrKeyMissing
+	case len(key) > s.MaxKeyLength:
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// checkKey checks the specified key and reports if it is not valid.
+// Keys may contain any characters (percent-encoded in paths) except for slashes.
+func (s *Server) checkKey(key string) error {
+	if key == "" {
+		return ErrKeyMissing
+	}
+	if len(key) > s.MaxKeyLength {
+		return ErrKeyTooLong
+	}
+	if strings.IndexByte(key, '/') >= 0 {
+		return ErrKeyInvalid
+	}
+	return nil
+}
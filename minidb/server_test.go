@@ -0,0 +1,900 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a Server serving a new, empty store.
+func newTestServer() *Server {
+	return NewServer(NewStore(DefaultShards))
+}
+
+// do serves a request with the given method, target and body by h,
+// and returns the recorded response.
+func do(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// decode decodes the JSON body of the response w into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Invalid JSON response %q: %v", w.Body.String(), err)
+	}
+}
+
+// errorCode returns the code of the JSON error response w.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	decode(t, w, &resp)
+	return resp.Error.Code
+}
+
+// put sets the value of key (acquiring its lock), and returns the lock id.
+func put(t *testing.T, h http.Handler, key, value string) string {
+	t.Helper()
+	w := do(h, http.MethodPut, PathValues+key, value)
+	if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+		t.Fatalf("PUT %s: got status %d: %s", key, w.Code, w.Body)
+	}
+	var resp struct {
+		LockId string `json:"lock_id"`
+	}
+	decode(t, w, &resp)
+	return resp.LockId
+}
+
+// waitUntil waits until cond holds, failing the test if it doesn't within a second.
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+	}
+}
+
+// waiters returns the number of waiters for the lock of key.
+func waiters(s *Store, key string) int {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+	if vw := sh.m[key]; vw != nil {
+		return len(vw.waiters)
+	}
+	return 0
+}
+
+func TestReservationsKeyValidation(t *testing.T) {
+	s := newTestServer()
+	cases := []struct {
+		name, path, code string
+	}{
+		{"empty key", PathReservations, CodeKeyMissing},
+		{"key with slash", PathReservations + "a/b", CodeKeyInvalid},
+		{"key with encoded slash", PathReservations + "a%2Fb", CodeKeyInvalid},
+	}
+	for _, c := range cases {
+		w := do(s, http.MethodPost, c.path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", c.name, w.Code, http.StatusBadRequest)
+			continue
+		}
+		if code := errorCode(t, w); code != c.code {
+			t.Errorf("%s: got code %q, want %q", c.name, code, c.code)
+		}
+	}
+}
+
+func TestValuesMissingKey(t *testing.T) {
+	s := newTestServer()
+	w := do(s, http.MethodGet, PathValues, "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if code := errorCode(t, w); code != CodeKeyMissing {
+		t.Errorf("Got code %q, want %q", code, CodeKeyMissing)
+	}
+}
+
+func TestReserveClientGone(t *testing.T) {
+	s := newTestServer()
+	lockId := put(t, s, "a", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := httptest.NewRequest(http.MethodPost, PathReservations+"a", nil).WithContext(ctx)
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	waitUntil(t, func() bool { return waiters(s.store, "a") == 1 })
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reservation still waiting after the client is gone")
+	}
+
+	if err := s.store.Release("a", lockId); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if w := do(s, http.MethodPost, PathReservations+"a?wait=false", ""); w.Code != http.StatusOK {
+		t.Errorf("Lock was acquired for the gone client (status %d)", w.Code)
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	s := newTestServer()
+	s.MaxValueSize = 4
+	lockId := put(t, s, "a", "1234")
+
+	w := do(s, http.MethodPost, PathValues+"a/"+lockId+"?release=false", "12345")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if code := errorCode(t, w); code != CodeTooLarge {
+		t.Errorf("Got code %q, want %q", code, CodeTooLarge)
+	}
+	if value, err := s.store.Get("a"); err != nil || value != "1234" {
+		t.Errorf("Got value %q (%v), want unchanged %q", value, err, "1234")
+	}
+
+	if w := do(s, http.MethodPut, PathValues+"b", "12345"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT: got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if _, err := s.store.Get("b"); err != ErrNotFound {
+		t.Errorf("Got error %v for over-limit PUT, want %v", err, ErrNotFound)
+	}
+}
+
+func TestHeadValue(t *testing.T) {
+	s := newTestServer()
+	put(t, s, "a", "hello") // Locked: HEAD must not wait for the lock
+
+	w := do(s, http.MethodHead, PathValues+"a", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "5" {
+		t.Errorf("Got Content-Length %q, want %q", cl, "5")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Got body %q, want none", w.Body)
+	}
+
+	w = do(s, http.MethodHead, PathValues+"missing", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Missing key: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Missing key: got body %q, want none", w.Body)
+	}
+}
+
+func TestBulkGet(t *testing.T) {
+	s := newTestServer()
+	put(t, s, "a", "1") // Locked: bulk get must not wait for the lock
+	put(t, s, "b", "")
+
+	w := do(s, http.MethodPost, PathBulkGet, `["a", "b", "missing"]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var values map[string]string
+	decode(t, w, &values)
+	want := map[string]string{"a": "1", "b": ""}
+	if len(values) != len(want) {
+		t.Errorf("Got values %v, want %v", values, want)
+	}
+	for key, value := range want {
+		if got, ok := values[key]; !ok || got != value {
+			t.Errorf("Got value %q (present: %t) for %s, want %q", got, ok, key, value)
+		}
+	}
+
+	s.MaxBulkKeys = 2
+	if w := do(s, http.MethodPost, PathBulkGet, `["a", "b", "c"]`); w.Code != http.StatusBadRequest {
+		t.Errorf("Too many keys: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestEncodedKeys(t *testing.T) {
+	s := newTestServer()
+	cases := []struct {
+		path, key string
+	}{
+		{"a%20b", "a b"},
+		{"%C3%A9t%C3%A9", "été"},
+		{"日本", "日本"},
+	}
+	for _, c := range cases {
+		lockId := put(t, s, c.path, "v")
+		if value, err := s.store.Get(c.key); err != nil || value != "v" {
+			t.Errorf("%s: got value %q (%v) for key %q", c.path, value, err, c.key)
+		}
+		if w := do(s, http.MethodPost, PathValues+c.path+"/"+lockId+"?release=true", "v2"); w.Code != http.StatusNoContent {
+			t.Errorf("%s: POST got status %d, want %d", c.path, w.Code, http.StatusNoContent)
+		}
+		if w := do(s, http.MethodPost, PathReservations+c.path, ""); w.Code != http.StatusOK {
+			t.Errorf("%s: reserve got status %d, want %d", c.path, w.Code, http.StatusOK)
+		}
+		if w := do(s, http.MethodPost, PathReservations+c.path+"?wait=false", ""); w.Code != http.StatusConflict {
+			t.Errorf("%s: key %q is not locked by the reservation (status %d)", c.path, c.key, w.Code)
+		}
+	}
+
+	// Encoded slashes are rejected just like slashes.
+	if w := do(s, http.MethodPut, PathValues+"a%2Fb", "v"); w.Code != http.StatusBadRequest {
+		t.Errorf("Encoded slash: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestKeyTooLong(t *testing.T) {
+	s := newTestServer()
+	s.MaxKeyLength = 8
+	atLimit, overLimit := strings.Repeat("k", 8), strings.Repeat("k", 9)
+
+	put(t, s, atLimit, "v")
+	if w := do(s, http.MethodGet, PathValues+atLimit, ""); w.Code != http.StatusOK {
+		t.Errorf("At limit: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	cases := []struct {
+		method, target string
+	}{
+		{http.MethodPut, PathValues + overLimit},
+		{http.MethodGet, PathValues + overLimit},
+		{http.MethodPost, PathReservations + overLimit},
+	}
+	for _, c := range cases {
+		w := do(s, c.method, c.target, "v")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.target, w.Code, http.StatusBadRequest)
+			continue
+		}
+		if code := errorCode(t, w); code != CodeKeyTooLong {
+			t.Errorf("%s %s: got code %q, want %q", c.method, c.target, code, CodeKeyTooLong)
+		}
+	}
+}
+
+// gzipped returns the gzip compressed form of s.
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(s))
+	gw.Close()
+	return buf.String()
+}
+
+func TestGzipBody(t *testing.T) {
+	s := newTestServer()
+	s.MaxValueSize = 1000
+	putGzip := func(key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, PathValues+key, strings.NewReader(body))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	value := strings.Repeat("hello ", 100)
+	if w := putGzip("a", gzipped(value)); w.Code != http.StatusCreated {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got, err := s.store.Get("a"); err != nil || got != value {
+		t.Errorf("Got value %q (%v), want the decompressed body", got, err)
+	}
+
+	if w := putGzip("b", "not gzip"); w.Code != http.StatusBadRequest {
+		t.Errorf("Malformed gzip: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	// Small compressed, but too large decompressed
+	if w := putGzip("c", gzipped(strings.Repeat("x", 1001))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Decompression bomb: got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	s := newTestServer()
+	lockId := put(t, s, "a", "1")
+	if err := s.store.Release("a", lockId); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	if w := do(s, http.MethodDelete, PathValues+"a?expect=2", ""); w.Code != http.StatusConflict {
+		t.Errorf("Mismatch: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if value, err := s.store.Get("a"); err != nil || value != "1" {
+		t.Errorf("Mismatch: got value %q (%v), want unchanged %q", value, err, "1")
+	}
+	if w := do(s, http.MethodDelete, PathValues+"missing?expect=1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Missing key: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, http.MethodDelete, PathValues+"a?expect=1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Match: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if _, err := s.store.Get("a"); err != ErrNotFound {
+		t.Errorf("Match: got error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	s := newTestServer()
+	if err := s.store.Release("a", put(t, s, "a", "1")); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	etag := do(s, http.MethodGet, PathValues+"a", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Missing ETag")
+	}
+	if got := do(s, http.MethodHead, PathValues+"a", "").Header().Get("ETag"); got != etag {
+		t.Errorf("HEAD: got ETag %q, want %q", got, etag)
+	}
+
+	putIfMatch := func(ifMatch, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, PathValues+"a", strings.NewReader(value))
+		r.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := putIfMatch(ETag("other"), "2"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Non-matching: got status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if value, _ := s.store.Get("a"); value != "1" {
+		t.Errorf("Non-matching: got value %q, want unchanged %q", value, "1")
+	}
+	if w := putIfMatch(etag, "2"); w.Code != http.StatusOK {
+		t.Errorf("Matching: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if value, _ := s.store.Get("a"); value != "2" {
+		t.Errorf("Matching: got value %q, want %q", value, "2")
+	}
+}
+
+func TestValidateLockId(t *testing.T) {
+	s := newTestServer()
+	put(t, s, "a", "1")
+	wrongId, err := genLockId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name, lockId string
+		status       int
+		code         string
+	}{
+		{"malformed", "nonsense", http.StatusBadRequest, CodeMalformedLockId},
+		{"malformed, right length", strings.Repeat("z", len(wrongId)), http.StatusBadRequest, CodeMalformedLockId},
+		{"well-formed, wrong", wrongId, http.StatusUnauthorized, CodeUnauthorized},
+	}
+	for _, c := range cases {
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			w := do(s, method, PathValues+"a/"+c.lockId+"?release=true", "2")
+			if w.Code != c.status {
+				t.Errorf("%s %s: got status %d, want %d", method, c.name, w.Code, c.status)
+				continue
+			}
+			if code := errorCode(t, w); code != c.code {
+				t.Errorf("%s %s: got code %q, want %q", method, c.name, code, c.code)
+			}
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := newTestServer()
+	srcLockId := put(t, s, "a", "1")
+	copyTo := func(key, to string) (string, *httptest.ResponseRecorder) {
+		w := do(s, http.MethodPost, PathValues+key+"/copy?to="+to, "")
+		var resp struct {
+			LockId string `json:"lock_id"`
+		}
+		if w.Code == http.StatusOK {
+			decode(t, w, &resp)
+		}
+		return resp.LockId, w
+	}
+
+	// To a new key
+	lockId, w := copyTo("a", "b")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if value, _ := s.store.Get("b"); value != "1" {
+		t.Errorf("Got value %q, want %q", value, "1")
+	}
+	if err := s.store.Release("b", lockId); err != nil {
+		t.Errorf("Destination is not locked by the returned lock id: %v", err)
+	}
+	// The lock of the source is not transferred.
+	if err := s.store.Release("a", srcLockId); err != nil {
+		t.Errorf("Source lock changed: %v", err)
+	}
+
+	// Overwrite
+	if err := s.store.Release("c", put(t, s, "c", "old")); err != nil {
+		t.Fatal(err)
+	}
+	if _, w := copyTo("a", "c"); w.Code != http.StatusOK {
+		t.Errorf("Overwrite: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if value, _ := s.store.Get("c"); value != "1" {
+		t.Errorf("Overwrite: got value %q, want %q", value, "1")
+	}
+
+	// Self-copy
+	lockId, w = copyTo("a", "a")
+	if w.Code != http.StatusOK {
+		t.Errorf("Self-copy: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if value, _ := s.store.Get("a"); value != "1" {
+		t.Errorf("Self-copy: got value %q, want %q", value, "1")
+	}
+	if err := s.store.Release("a", lockId); err != nil {
+		t.Errorf("Self-copy: key is not locked by the returned lock id: %v", err)
+	}
+
+	if _, w := copyTo("missing", "d"); w.Code != http.StatusNotFound {
+		t.Errorf("Missing source: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, w := copyTo("a", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid destination: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	s := newTestServer()
+	put(t, s, "empty", "")
+
+	w := do(s, http.MethodGet, PathValues+"empty", "")
+	var resp struct {
+		Value *string `json:"value"`
+		Empty bool    `json:"empty"`
+	}
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Value == nil || *resp.Value != "" || !resp.Empty {
+		t.Errorf("GET: got status %d, body %s, want 200 with an explicitly empty value", w.Code, w.Body)
+	}
+	if w := do(s, http.MethodGet, PathValues+"empty?raw=true", ""); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Raw GET: got status %d, body %q, want 200 with empty body", w.Code, w.Body)
+	}
+	if w := do(s, http.MethodHead, PathValues+"empty", ""); w.Code != http.StatusOK || w.Header().Get("Content-Length") != "0" {
+		t.Errorf("HEAD: got status %d, Content-Length %q, want 200 and 0", w.Code, w.Header().Get("Content-Length"))
+	}
+	if w := do(s, http.MethodGet, PathValues+"empty/meta", ""); w.Code != http.StatusOK {
+		t.Errorf("Meta: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for _, c := range []struct{ method, target string }{
+		{http.MethodGet, PathValues + "missing"},
+		{http.MethodGet, PathValues + "missing?raw=true"},
+		{http.MethodHead, PathValues + "missing"},
+		{http.MethodGet, PathValues + "missing/meta"},
+	} {
+		if w := do(s, c.method, c.target, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got status %d, want %d", c.method, c.target, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestBodyTimeout(t *testing.T) {
+	s := newTestServer()
+	s.BodyTimeout = 100 * time.Millisecond
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// Trickle the body: a byte, then nothing.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("a"))
+	req, err := http.NewRequest(http.MethodPut, ts.URL+PathValues+"a", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Got status %d, want %d", resp.StatusCode, http.StatusRequestTimeout)
+	}
+	if _, err := s.store.Get("a"); err != ErrNotFound {
+		t.Errorf("Got error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestMaxWaiters(t *testing.T) {
+	s := newTestServer()
+	s.store.SetMaxWaiters(2)
+	lockId := put(t, s, "a", "1")
+
+	done := make(chan *httptest.ResponseRecorder, 2)
+	for i := 1; i <= 2; i++ {
+		go func() { done <- do(s, http.MethodPost, PathReservations+"a", "") }()
+		waitUntil(t, func() bool { return waiters(s.store, "a") == i })
+	}
+
+	w := do(s, http.MethodPost, PathReservations+"a", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Missing Retry-After header")
+	}
+	if code := errorCode(t, w); code != CodeQueueFull {
+		t.Errorf("Got code %q, want %q", code, CodeQueueFull)
+	}
+	if n := waiters(s.store, "a"); n != 2 {
+		t.Errorf("Got %d waiters, want 2", n)
+	}
+
+	// Let the queued reservations through.
+	for i := 0; i < 2; i++ {
+		if err := s.store.Release("a", lockId); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+		w := <-done
+		if w.Code != http.StatusOK {
+			t.Fatalf("Queued reservation: got status %d, want %d", w.Code, http.StatusOK)
+		}
+		var resp struct {
+			LockId string `json:"lock_id"`
+		}
+		decode(t, w, &resp)
+		lockId = resp.LockId
+	}
+}
+
+func TestReserveUntil(t *testing.T) {
+	s := newTestServer()
+	lockId := put(t, s, "a", "0")
+	if err := s.store.Release("a", lockId); err != nil {
+		t.Fatal(err)
+	}
+	set := func(value string) {
+		t.Helper()
+		lockId := put(t, s, "a", value)
+		if w := do(s, http.MethodPost, PathValues+"a/"+lockId+"?release=true", value); w.Code != http.StatusNoContent {
+			t.Fatalf("Set %q: got status %d", value, w.Code)
+		}
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- do(s, http.MethodPost, PathReservations+"a?until=go&timeout=5s", "") }()
+	set("other")
+	select {
+	case w := <-done:
+		t.Fatalf("Reservation returned (status %d) before the value became %q", w.Code, "go")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	set("go")
+	var w *httptest.ResponseRecorder
+	select {
+	case w = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Waiter didn't wake when the value became the expected one")
+	}
+	var resp struct {
+		LockId string `json:"lock_id"`
+		Value  string `json:"value"`
+	}
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Value != "go" {
+		t.Errorf("Got status %d, value %q, want 200 and %q", w.Code, resp.Value, "go")
+	}
+	if err := s.store.Release("a", resp.LockId); err != nil {
+		t.Errorf("Key is not locked by the reservation: %v", err)
+	}
+
+	if w := do(s, http.MethodPost, PathReservations+"a?until=never&timeout=50ms", ""); w.Code != http.StatusRequestTimeout {
+		t.Errorf("Timeout: got status %d, want %d", w.Code, http.StatusRequestTimeout)
+	}
+}
+
+func TestReserveIf(t *testing.T) {
+	s := newTestServer()
+
+	// if=absent creates the key, locked.
+	w := do(s, http.MethodPost, PathReservations+"leader?if=absent", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Absent key: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var resp struct {
+		LockId string `json:"lock_id"`
+	}
+	decode(t, w, &resp)
+	if value, err := s.store.Get("leader"); err != nil || value != "" {
+		t.Errorf("Got value %q (%v), want created empty", value, err)
+	}
+	if meta, _ := s.store.Meta("leader"); !meta.Locked {
+		t.Error("Created key is not locked")
+	}
+	if err := s.store.Release("leader", resp.LockId); err != nil {
+		t.Errorf("Key is not locked by the returned lock id: %v", err)
+	}
+	// Existing, even if unlocked
+	if w := do(s, http.MethodPost, PathReservations+"leader?if=absent", ""); w.Code != http.StatusConflict {
+		t.Errorf("Existing key: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	// if=present (the default) only locks existing keys.
+	for _, query := range []string{"?if=present", ""} {
+		if w := do(s, http.MethodPost, PathReservations+"missing"+query, ""); w.Code != http.StatusNotFound {
+			t.Errorf("Missing key %q: got status %d, want %d", query, w.Code, http.StatusNotFound)
+		}
+	}
+	if w := do(s, http.MethodPost, PathReservations+"leader?if=present", ""); w.Code != http.StatusOK {
+		t.Errorf("Existing key: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := do(s, http.MethodPost, PathReservations+"leader?if=other", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid condition: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPutCreated(t *testing.T) {
+	s := newTestServer()
+
+	w := do(s, http.MethodPut, PathValues+"a", "1")
+	if w.Code != http.StatusCreated {
+		t.Errorf("Create: got status %d, want %d", w.Code, http.StatusCreated)
+	}
+	if loc := w.Header().Get("Location"); loc != PathValues+"a" {
+		t.Errorf("Create: got Location %q, want %q", loc, PathValues+"a")
+	}
+	var resp struct {
+		LockId string `json:"lock_id"`
+	}
+	decode(t, w, &resp)
+	if err := s.store.Release("a", resp.LockId); err != nil {
+		t.Fatalf("Create: key is not locked by the returned lock id: %v", err)
+	}
+
+	w = do(s, http.MethodPut, PathValues+"a", "2")
+	if w.Code != http.StatusOK {
+		t.Errorf("Update: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if loc := w.Header().Get("Location"); loc != "" {
+		t.Errorf("Update: got Location %q, want none", loc)
+	}
+	resp.LockId = ""
+	decode(t, w, &resp)
+	if resp.LockId == "" {
+		t.Error("Update: missing lock id")
+	}
+}
+
+func TestLockWaitingStats(t *testing.T) {
+	s := newTestServer()
+	lockWaiting := func() int64 {
+		var stats Stats
+		decode(t, do(s, http.MethodGet, PathStats, ""), &stats)
+		return stats.LockWaiting
+	}
+	base := lockWaiting() // Shared by all stores
+	lockId := put(t, s, "a", "1")
+
+	// Falls on acquire
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- do(s, http.MethodPost, PathReservations+"a", "") }()
+	waitUntil(t, func() bool { return lockWaiting() == base+1 })
+	metrics := do(s, http.MethodGet, PathMetrics, "").Body.String()
+	if want := fmt.Sprintf("minidb_lock_waiting %d\n", base+1); !strings.Contains(metrics, want) {
+		t.Errorf("Metrics don't contain %q", want)
+	}
+	if err := s.store.Release("a", lockId); err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		LockId string `json:"lock_id"`
+	}
+	decode(t, <-done, &resp)
+	if n := lockWaiting(); n != base {
+		t.Errorf("Got %d waiting after acquire, want %d", n, base)
+	}
+
+	// Falls on cancel
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		r := httptest.NewRequest(http.MethodPost, PathReservations+"a", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		done <- w
+	}()
+	waitUntil(t, func() bool { return lockWaiting() == base+1 })
+	cancel()
+	<-done
+	if n := lockWaiting(); n != base {
+		t.Errorf("Got %d waiting after cancel, want %d", n, base)
+	}
+}
+
+func TestAdminDeletePrefix(t *testing.T) {
+	s := newTestServer()
+	s.AdminToken = "secret"
+	for _, key := range []string{"foo1", "foo2", "foo3", "bar"} {
+		if err := s.store.Release(key, put(t, s, key, "v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(t, s, "foo4", "v") // Locked
+	deletePrefix := func(prefix, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, PathAdminValues+"?prefix="+prefix, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := deletePrefix("foo", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong token: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := deletePrefix("", "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("Missing prefix: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := deletePrefix("foo", "secret")
+	var resp struct {
+		Deleted int `json:"deleted"`
+		Skipped int `json:"skipped"`
+	}
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Deleted != 3 || resp.Skipped != 1 {
+		t.Errorf("Got status %d, %d deleted, %d skipped, want 200, 3 and 1", w.Code, resp.Deleted, resp.Skipped)
+	}
+	for key, want := range map[string]bool{"foo1": false, "foo2": false, "foo3": false, "foo4": true, "bar": true} {
+		if _, err := s.store.Get(key); (err == nil) != want {
+			t.Errorf("Key %s present: %t, want %t", key, err == nil, want)
+		}
+	}
+}
+
+func TestReleaseEach(t *testing.T) {
+	s := newTestServer()
+	lockA, lockB := put(t, s, "a", "1"), put(t, s, "b", "2")
+	body := fmt.Sprintf(`{"a": %q, "b": "wrong", "c": %q}`, lockA, lockB)
+	w := do(s, http.MethodPost, PathReleaseEach, body)
+	var resp struct {
+		Results  map[string]string `json:"results"`
+		Released int               `json:"released"`
+		Failed   int               `json:"failed"`
+	}
+	decode(t, w, &resp)
+	want := map[string]string{"a": ReleaseReleased, "b": ReleaseWrongLock, "c": ReleaseNotFound}
+	if w.Code != http.StatusOK || resp.Released != 1 || resp.Failed != 2 {
+		t.Errorf("Got status %d, %d released, %d failed, want 200, 1 and 2", w.Code, resp.Released, resp.Failed)
+	}
+	for key, result := range want {
+		if resp.Results[key] != result {
+			t.Errorf("Got result %q for %s, want %q", resp.Results[key], key, result)
+		}
+	}
+
+	// Both forms of releases are limited to MaxBulkKeys keys.
+	s.MaxBulkKeys = 1
+	body = fmt.Sprintf(`{"a": %q, "b": %q}`, lockA, lockB)
+	for _, target := range []string{PathReleaseEach, PathMultiReserve, PathMultiReserve + "?atomic=false"} {
+		method := http.MethodDelete
+		if target == PathReleaseEach {
+			method = http.MethodPost
+		}
+		if w := do(s, method, target, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: got status %d, want %d", method, target, w.Code, http.StatusBadRequest)
+		}
+	}
+	if err := s.store.Release("b", lockB); err != nil {
+		t.Errorf("Lock of b is released by rejected requests: %v", err)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	s := newTestServer()
+	ctx := context.Background()
+	l, _, err := s.store.Put(ctx, "a", "1", "", 0)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.store.Release("a", l.Id); err != nil {
+		t.Fatal(err)
+	}
+	if l, _, err = s.store.Put(ctx, "a", `{"x":2}`, "application/json", time.Hour); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.store.Release("a", l.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.Delete("b", put(t, s, "b", "3")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	w := do(s, http.MethodGet, PathChanges, "")
+	var changes []Change
+	decode(t, w, &changes)
+	// Puts have the current values, puts of deleted keys are reported as deletes.
+	want := []Change{
+		{Event: Event{Seq: 1, Op: OpPut, Key: "a"}, Value: `{"x":2}`, ContentType: "application/json"},
+		{Event: Event{Seq: 2, Op: OpPut, Key: "a"}, Value: `{"x":2}`, ContentType: "application/json"},
+		{Event: Event{Seq: 3, Op: OpDelete, Key: "b"}},
+		{Event: Event{Seq: 4, Op: OpDelete, Key: "b"}},
+	}
+	if w.Code != http.StatusOK || len(changes) != len(want) {
+		t.Fatalf("Got status %d, changes %v, want %v", w.Code, changes, want)
+	}
+	for i, c := range changes {
+		if c.Event != want[i].Event || c.Value != want[i].Value || c.ContentType != want[i].ContentType {
+			t.Errorf("Got change %v, want %v", c, want[i])
+		}
+		if hasExpires := c.Expires != nil; hasExpires != (c.Op == OpPut) {
+			t.Errorf("Change %d has expiry: %t", c.Seq, hasExpires)
+		}
+	}
+}
+
+func TestDryRunValidation(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(s *Server) (method, target, body string)
+		want  int
+	}{
+		{"put over budget", func(s *Server) (string, string, string) {
+			s.store.SetMaxBytes(10)
+			put(t, s, "a", "12345678") // Locked, can't be evicted
+			return http.MethodPut, PathValues + "b?ttl=1m", "123"
+		}, http.StatusInsufficientStorage},
+		{"update over budget", func(s *Server) (string, string, string) {
+			s.store.SetMaxBytes(10)
+			put(t, s, "a", "12345678")
+			return http.MethodPost, PathValues + "b/" + put(t, s, "b", "1") + "?release=true", "12345"
+		}, http.StatusInsufficientStorage},
+		{"update expired value", func(s *Server) (string, string, string) {
+			l, _, err := s.store.Put(context.Background(), "a", "1", "", time.Nanosecond)
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+			return http.MethodPost, PathValues + "a/" + l.Id + "?release=true", "2"
+		}, http.StatusNotFound},
+		{"reserve locked", func(s *Server) (string, string, string) {
+			put(t, s, "a", "1")
+			return http.MethodPost, PathReservations + "a?wait=false", ""
+		}, http.StatusConflict},
+		{"reserve absent of existing", func(s *Server) (string, string, string) {
+			put(t, s, "a", "1")
+			return http.MethodPost, PathReservations + "a?if=absent", ""
+		}, http.StatusConflict},
+	}
+	for _, c := range cases {
+		for _, dry := range []bool{true, false} {
+			s := newTestServer()
+			method, target, body := c.setup(s)
+			if dry {
+				target += "&dry_run=true"
+			}
+			if w := do(s, method, target, body); w.Code != c.want {
+				t.Errorf("%s (dry run: %t): got status %d, want %d", c.name, dry, w.Code, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,1637 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("Key not found!")
+	ErrUnauthorized = errors.New("Lock ID does not identify the currently held lock!")
+	ErrLocked       = errors.New("Key is locked!")
+	ErrExpired      = errors.New("Lock has expired!")
+	ErrMismatch     = errors.New("Value does not match the expected value!")
+	ErrNotInteger   = errors.New("Value is not an integer!")
+	ErrPrecondition = errors.New("ETag of the value does not match!")
+	ErrExists       = errors.New("Key already exists!")
+	ErrTooLarge     = errors.New("Value would be too large!")
+	ErrQueueFull    = errors.New("Too many waiters for the key!")
+
+	ErrInsufficientStorage = errors.New("Memory budget of the store would be exceeded!")
+	ErrCorrupt             = errors.New("Stored value is corrupt!")
+)
+
+// ETag returns the strong entity tag of value: its quoted, hex encoded SHA-256 hash.
+func ETag(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Lock identifies an acquired lock.
+type Lock struct {
+	Id string // Lock ID
+
+	// Fence is the fencing token of the lock, which strictly increases
+	// with each acquisition of any lock (even across deletion of keys).
+	// Resources protected by the lock may reject operations carrying a
+	// fencing token lower than the highest they've seen, so stale lock holders
+	// (e.g. whose lock expired) can be detected.
+	Fence uint64
+
+	Expires time.Time // Time when the lock expires, zero value means it never expires
+}
+
+// Encodings of lock ids.
+const (
+	LockIdHex    = "hex"    // Hexadecimal
+	LockIdBase64 = "base64" // URL-safe base64 without padding
+)
+
+// Format of the generated lock ids, set by SetLockIdFormat.
+var (
+	lockIdLength   = LockIdLength // Number of random bytes
+	lockIdEncoding = LockIdHex    // Encoding of the random bytes
+)
+
+// SetLockIdFormat sets the format of the generated lock ids: the number of random bytes
+// (at least LockIdLength, so ids don't collide) and their encoding (LockIdHex or LockIdBase64).
+// It must be called before any store is used.
+func SetLockIdFormat(length int, encoding string) error {
+	if length < LockIdLength {
+		return fmt.Errorf("lock id length must be at least %d bytes", LockIdLength)
+	}
+	if encoding != LockIdHex && encoding != LockIdBase64 {
+		return fmt.Errorf("invalid lock id encoding: %q", encoding)
+	}
+	lockIdLength, lockIdEncoding = length, encoding
+	return nil
+}
+
+// fenceCounter is the last issued fencing token, must be accessed atomically.
+var fenceCounter uint64
+
+// lockWaiting is the number of goroutines currently waiting for locks (see valueWr.Lock),
+// must be accessed atomically. Since waiters give up when their context is done,
+// it should not climb steadily: that would signal leaking waiters.
+var lockWaiting int64
+
+// nextFence returns the next fencing token.
+func nextFence() uint64 {
+	return atomic.AddUint64(&fenceCounter, 1)
+}
+
+// waitHookKey is the context key of the wait hook.
+type waitHookKey struct{}
+
+// WithWaitHook returns a copy of ctx carrying hook, which is called by the store operations
+// given the returned context with true when they start waiting (e.g. for a lock or for a change),
+// and with false when they stop waiting. The hook already in ctx (if any) is called too
+// (after hook), so hooks of multiple middlewares can be stacked.
+func WithWaitHook(ctx context.Context, hook func(waiting bool)) context.Context {
+	if outer, _ := ctx.Value(waitHookKey{}).(func(waiting bool)); outer != nil {
+		inner := hook
+		hook = func(waiting bool) {
+			inner(waiting)
+			outer(waiting)
+		}
+	}
+	return context.WithValue(ctx, waitHookKey{}, hook)
+}
+
+// beginWait calls the wait hook of ctx (if any) telling waiting starts,
+// and returns a function to call when waiting ends.
+func beginWait(ctx context.Context) (endWait func()) {
+	hook, _ := ctx.Value(waitHookKey{}).(func(waiting bool))
+	if hook == nil {
+		return func() {}
+	}
+	hook(true)
+	return func() { hook(false) }
+}
+
+// valueWr struct is a wrapper which holds the value and its lock
+type valueWr struct {
+	LockId  string    // Lock ID
+	Expires time.Time // Time when the lock expires, zero value means it never expires
+	Fence   uint64    // Fencing token of the lock
+
+	// data is the value, compressed if compressed is true (use value() to get it).
+	// size is the length of the (uncompressed) value.
+	data       string
+	size       int
+	compressed bool
+
+	LockedAt time.Time // Time when the lock was acquired
+	Owner    string    // Identity of the lock holder given by the client (informational only)
+	warned   bool      // Tells if the lock has been reported by the watchdog as held too long
+
+	// held tells if the lock is held, used to maintain mutual exclusion.
+	// The lock may be held without a lock id while it is being handed over to a waiter.
+	held bool
+	// waiters is the FIFO queue of the waiters for the lock, so the lock is granted
+	// in arrival order. A waiter's channel is closed when the lock is handed over to it.
+	waiters []chan struct{}
+
+	ExpiredLockId string // Lock ID of the last lock that expired and was released
+
+	CreatedAt time.Time // Time when the key was created
+	UpdatedAt time.Time // Time when the value was last set
+
+	ValueExpires time.Time // Time when the value expires (and the key is deleted), zero value means it never expires
+	ContentType  string    // Content type of the value if it was set with one (e.g. "application/json")
+
+	Version uint64 // Version of the value, incremented each time the value is set
+
+	// changed is closed (and replaced) when the value is set or the key is deleted, to wake
+	// the watchers (see waitChange). It works like the broadcast of a sync.Cond, but it can be
+	// waited for together with a context. Watching doesn't involve the lock of the value.
+	changed chan struct{}
+
+	Accesses uint64 // Number of reads, writes and reservations of the value, must be accessed atomically
+}
+
+// newValueWr creates a new, unlocked valueWr.
+func newValueWr() *valueWr {
+	now := time.Now()
+	return &valueWr{CreatedAt: now, UpdatedAt: now, changed: make(chan struct{})}
+}
+
+// set sets the value (without a content type), and wakes the watchers of the value.
+// The value is compressed if compressMin > 0 and it is at least compressMin bytes
+// (and compressing makes it smaller).
+func (vw *valueWr) set(value string, compressMin int) {
+	vw.data, vw.size, vw.compressed = value, len(value), false
+	if compressMin > 0 && len(value) >= compressMin {
+		if data, ok := deflate(value); ok {
+			vw.data, vw.compressed = data, true
+		}
+	}
+	vw.ContentType = ""
+	vw.UpdatedAt = time.Now()
+	vw.Version++
+	vw.notify()
+}
+
+// value returns the value, decompressing it if it is stored compressed.
+// Returns ErrCorrupt (wrapped) if the compressed value can't be decompressed.
+func (vw *valueWr) value() (string, error) {
+	if !vw.compressed {
+		return vw.data, nil
+	}
+	return inflate(vw.data)
+}
+
+// expiryAfter returns the expiry time of a value set now to expire after ttl,
+// or the zero value (never expires) if ttl is 0.
+func expiryAfter(ttl time.Duration) time.Time {
+	if ttl > 0 {
+		return time.Now().Add(ttl)
+	}
+	return time.Time{}
+}
+
+// valueExpired tells if the value has a TTL which has elapsed by now.
+// Expired values are treated as nonexistent by reads even before they are swept.
+func (vw *valueWr) valueExpired(now time.Time) bool {
+	return !vw.ValueExpires.IsZero() && now.After(vw.ValueExpires)
+}
+
+// accessed counts an access (read, write or reservation) of the value.
+// It may be called with the shard locked for reading only.
+func (vw *valueWr) accessed() {
+	atomic.AddUint64(&vw.Accesses, 1)
+}
+
+// notify wakes the watchers of the value. It must be called when the value
+// is set or the key is deleted.
+func (vw *valueWr) notify() {
+	close(vw.changed)
+	vw.changed = make(chan struct{})
+}
+
+// waitChange waits until the value is set or the key is deleted, or ctx is done,
+// in which case ctx.Err() is returned.
+// mux (the shard mutex, or its read locker) must be locked by the caller, it is unlocked
+// while waiting. Since the change to wait for is taken before mux is unlocked, and changes
+// require mux locked for writing, a change in between can't be missed (no lost wakeups).
+// Since any change wakes the waiter, the caller must check its condition again.
+func (vw *valueWr) waitChange(ctx context.Context, mux sync.Locker) error {
+	changed := vw.changed
+	mux.Unlock()
+	defer mux.Lock()
+
+	endWait := beginWait(ctx)
+	defer endWait()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Lock waits for the value to be available and acquires the lock,
+// and generates a new lock id. Waiters are granted the lock in arrival order (FIFO).
+// Lock gives up waiting if ctx is done (e.g. the client went away or a timeout elapsed),
+// in which case the lock is not taken and ctx.Err() is returned.
+// If generating the lock id fails, the lock is not taken either.
+// mux must be locked by the caller, it is unlocked while waiting.
+func (vw *valueWr) Lock(ctx context.Context, mux sync.Locker) error {
+	if !vw.held && len(vw.waiters) == 0 {
+		// Lock is available, no need to wait
+		vw.held = true
+		return vw.locked()
+	}
+
+	ticket := make(chan struct{})
+	vw.waiters = append(vw.waiters, ticket)
+	// While we wait, we have to release the store mutex
+	// else noone else would be able to release the value we're waiting for:
+	mux.Unlock()
+	atomic.AddInt64(&lockWaiting, 1)
+	endWait := beginWait(ctx)
+	select {
+	case <-ticket:
+		endWait()
+		atomic.AddInt64(&lockWaiting, -1)
+		mux.Lock()
+	case <-ctx.Done():
+		endWait()
+		atomic.AddInt64(&lockWaiting, -1)
+		mux.Lock()
+		select {
+		case <-ticket:
+			// Lock was handed over to us meanwhile, pass it on
+			vw.release()
+		default:
+			vw.leaveQueue(ticket)
+		}
+		return ctx.Err()
+	}
+
+	return vw.locked()
+}
+
+// TryLock acquires the lock and generates a new lock id if the value is available,
+// without waiting.
+// Returns ErrLocked if the lock is held by someone else (or others are waiting for it).
+func (vw *valueWr) TryLock() error {
+	if vw.held || len(vw.waiters) > 0 {
+		return ErrLocked
+	}
+	vw.held = true
+	return vw.locked()
+}
+
+// locked must be called right after the lock is acquired, it generates
+// the new lock id and fencing token.
+// If generating the lock id fails, the lock is released.
+func (vw *valueWr) locked() error {
+	lockId, err := genLockId()
+	if err != nil {
+		vw.release()
+		return err
+	}
+	vw.LockId, vw.Fence = lockId, nextFence()
+	vw.LockedAt, vw.warned, vw.Owner = time.Now(), false, ""
+	return nil
+}
+
+// Unlock releases the lock for the value and invalidates previous lock id.
+// Unlocking an already released lock is a no-op.
+func (vw *valueWr) Unlock() {
+	if vw.LockId == "" {
+		return
+	}
+	vw.LockId = ""
+	vw.Expires = time.Time{}
+	vw.Owner = ""
+	vw.release()
+}
+
+// release hands the lock over to the first waiter if there is any,
+// else marks the lock available.
+func (vw *valueWr) release() {
+	if len(vw.waiters) == 0 {
+		vw.held = false
+		return
+	}
+	ticket := vw.waiters[0]
+	vw.waiters[0] = nil
+	vw.waiters = vw.waiters[1:]
+	close(ticket) // Lock remains held, by the waiter
+}
+
+// leaveQueue removes the waiter of ticket from the queue of waiters.
+func (vw *valueWr) leaveQueue(ticket chan struct{}) {
+	for i, t := range vw.waiters {
+		if t == ticket {
+			vw.waiters = append(vw.waiters[:i], vw.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// lock returns the currently held lock.
+func (vw *valueWr) lock() Lock {
+	return Lock{Id: vw.LockId, Fence: vw.Fence, Expires: vw.Expires}
+}
+
+// expired tells if the lock has a TTL which has elapsed by now.
+func (vw *valueWr) expired(now time.Time) bool {
+	return !vw.Expires.IsZero() && now.After(vw.Expires)
+}
+
+// releaseExpired releases an expired lock, remembering its lock id.
+func (vw *valueWr) releaseExpired() {
+	vw.ExpiredLockId = vw.LockId
+	vw.Unlock()
+}
+
+// shard is a partition of the store, holding the keys whose hash maps to it.
+type shard struct {
+	// mux is used to synchronize access to the shard.
+	// RWMutex which allows efficient read-only locking for read-only queries.
+	mux sync.RWMutex
+
+	// m maps from key to *valueWr which contains the value and also its lock.
+	m map[string]*valueWr
+
+	// maxWaiters is the max number of waiters for the lock of a key, 0 means no limit.
+	maxWaiters int
+}
+
+// Store is the in-memory key/value store where each key/value can be locked.
+// Its methods are safe for concurrent use.
+//
+// Keys are partitioned into shards (by the FNV hash of the key), each having
+// its own mutex, so operations on different keys contend less.
+type Store struct {
+	shards []*shard
+
+	wal    *WAL      // Optional write-ahead log of mutations
+	events *eventHub // Hub of the mutation events
+
+	lru       *lru   // Access order of keys if LRU eviction is enabled
+	maxKeys   int    // Max number of keys if LRU eviction is enabled
+	evictions uint64 // Number of evicted keys, must be accessed atomically
+
+	watchdog        time.Duration // Locks held longer than this are reported if the watchdog is enabled
+	watchdogRelease bool          // Tells if the watchdog force-releases the reported locks
+
+	compressMin int // Values at least this large are stored compressed, 0 disables compression
+
+	maxBytes int64 // Max total size of the values, 0 means no limit
+	bytes    int64 // Total size of the values as stored, must be accessed atomically
+}
+
+// NewStore creates a new, empty Store with the given number of shards.
+// If shards < 1, a single shard is used.
+func NewStore(shards int) *Store {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &Store{shards: make([]*shard, shards), events: newEventHub(eventHistorySize)}
+	for i := range s.shards {
+		s.shards[i] = &shard{m: make(map[string]*valueWr)}
+	}
+	return s
+}
+
+// SetMaxWaiters limits the number of waiters for the lock of each key to maxWaiters
+// (0 means no limit): operations which would wait beyond the limit fail with ErrQueueFull
+// instead of queueing. It must be called before the store is used.
+func (s *Store) SetMaxWaiters(maxWaiters int) {
+	for _, sh := range s.shards {
+		sh.maxWaiters = maxWaiters
+	}
+}
+
+// SetChangeHistory sets the number of recent changes kept for resuming event streams
+// and for /changes (at least 1). It must be called before the store is used.
+func (s *Store) SetChangeHistory(size int) {
+	s.events = newEventHub(size)
+}
+
+// lockAll locks all shards for writing (in order, so it can't deadlock with other lockAll calls).
+func (s *Store) lockAll() {
+	for _, sh := range s.shards {
+		sh.mux.Lock()
+	}
+}
+
+// unlockAll unlocks all shards locked by lockAll.
+func (s *Store) unlockAll() {
+	for _, sh := range s.shards {
+		sh.mux.Unlock()
+	}
+}
+
+// shard returns the shard holding key.
+func (s *Store) shard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard holding key.
+func (s *Store) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// lockShardsOf locks the shards holding keys (each once), in shard index order,
+// so concurrent callers can't deadlock. The returned function unlocks them.
+func (s *Store) lockShardsOf(keys ...string) (unlock func()) {
+	idxs := make([]int, 0, len(keys))
+	for _, key := range keys {
+		idxs = append(idxs, s.shardIndex(key))
+	}
+	sort.Ints(idxs)
+	var locked []*shard
+	for i, idx := range idxs {
+		if i > 0 && idx == idxs[i-1] {
+			continue
+		}
+		s.shards[idx].mux.Lock()
+		locked = append(locked, s.shards[idx])
+	}
+	return func() {
+		for _, sh := range locked {
+			sh.mux.Unlock()
+		}
+	}
+}
+
+// Get returns the value of key, or ErrNotFound if key doesn't exist.
+// Get does not touch the lock of the value, so it never waits.
+func (s *Store) Get(key string) (value string, err error) {
+	value, _, err = s.GetTyped(key)
+	return
+}
+
+// GetTyped is like Get, but it also returns the content type of the value
+// (empty if it was set without one).
+func (s *Store) GetTyped(key string) (value, contentType string, err error) {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	vw := sh.m[key]
+	if vw == nil || vw.valueExpired(time.Now()) {
+		return "", "", ErrNotFound
+	}
+	s.touch(key)
+	vw.accessed()
+	if value, err = vw.value(); err != nil {
+		return "", "", err
+	}
+	return value, vw.ContentType, nil
+}
+
+// GetAll returns the values of the given keys, mapped from key.
+// Keys that don't exist are omitted. Locks are not acquired (nor waited for).
+func (s *Store) GetAll(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := s.Get(key)
+		switch err {
+		case nil:
+			values[key] = value
+		case ErrNotFound:
+		default:
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// Put waits for key to be available and acquires its lock (creating key first
+// if it doesn't exist, which never waits), then sets its value.
+// If ttl > 0, the value expires (and key is deleted) after ttl, else it never expires.
+// contentType is recorded as the content type of the value (may be empty).
+// Returns the lock id and whether key was created, or ctx.Err() if ctx is done before the lock
+// is acquired.
+func (s *Store) Put(ctx context.Context, key, value, contentType string, ttl time.Duration) (l Lock, created bool, err error) {
+	defer s.evict(key) // After the shard is unlocked
+	s.makeRoom(len(value), key)
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, created, err := sh.lockOrCreate(ctx, key)
+	if err != nil {
+		return Lock{}, false, err
+	}
+	if !s.fits(vw, len(value)) {
+		sh.abandon(key, vw, created)
+		return Lock{}, false, ErrInsufficientStorage
+	}
+	rec := putRecord(key, value, contentType, expiryAfter(ttl))
+	if err := s.logMutation(rec); err != nil {
+		sh.abandon(key, vw, created)
+		return Lock{}, false, err
+	}
+	created = created || vw.valueExpired(time.Now()) // An expired value counts as nonexistent
+	s.setRecord(vw, rec)
+	vw.accessed()
+	return vw.lock(), created, nil
+}
+
+// Incr adds by to the integer value of key, and returns the new value.
+// A missing key (or an expired value) or an empty value counts as 0, a missing key is created.
+// The lock of key is acquired (waiting for it if needed) for the operation,
+// and released right after it. Returns ErrNotInteger if the value is not an integer.
+func (s *Store) Incr(ctx context.Context, key string, by int64) (int64, error) {
+	defer s.evict(key) // After the shard is unlocked
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, created, err := sh.lockOrCreate(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	expired := vw.valueExpired(time.Now())
+	var n int64
+	if vw.size > 0 && !expired {
+		current, err := vw.value()
+		if err != nil {
+			sh.abandon(key, vw, created)
+			return 0, err
+		}
+		if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+			sh.abandon(key, vw, created)
+			return 0, ErrNotInteger
+		}
+	}
+	n += by
+	expires := vw.ValueExpires
+	if expired {
+		expires = time.Time{} // A new value, the TTL was of the expired one
+	}
+	rec := putRecord(key, strconv.FormatInt(n, 10), "", expires)
+	if err := s.logMutation(rec); err != nil {
+		sh.abandon(key, vw, created)
+		return 0, err
+	}
+	s.setRecord(vw, rec)
+	vw.Unlock()
+	return n, nil
+}
+
+// Append waits for key to be available (creating key first if it doesn't exist),
+// and appends data to its value (an expired value counts as empty), which is then unlocked.
+// If the new value would be longer than maxSize bytes, it's not set and ErrTooLarge is returned.
+// Returns the length of the new value, or ctx.Err() if ctx is done before the lock is acquired.
+func (s *Store) Append(ctx context.Context, key, data string, maxSize int64) (int, error) {
+	defer s.evict(key) // After the shard is unlocked
+	s.makeRoom(len(data), key)
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, created, err := sh.lockOrCreate(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	expired := vw.valueExpired(time.Now())
+	current := vw.size
+	if expired {
+		current = 0
+	}
+	if int64(current)+int64(len(data)) > maxSize {
+		sh.abandon(key, vw, created)
+		return 0, ErrTooLarge
+	}
+	if !s.fits(vw, current+len(data)) {
+		sh.abandon(key, vw, created)
+		return 0, ErrInsufficientStorage
+	}
+	value := data
+	if !expired {
+		current, err := vw.value()
+		if err != nil {
+			sh.abandon(key, vw, created)
+			return 0, err
+		}
+		value = current + data
+	}
+	expires := vw.ValueExpires
+	if expired {
+		expires = time.Time{} // A new value, the TTL was of the expired one
+	}
+	rec := putRecord(key, value, "", expires)
+	if err := s.logMutation(rec); err != nil {
+		sh.abandon(key, vw, created)
+		return 0, err
+	}
+	s.setRecord(vw, rec)
+	vw.Unlock()
+	return len(value), nil
+}
+
+// Copy sets the value of the key to to the value of key atomically, and acquires the lock of to
+// (creating it if it doesn't exist). The lock of key is not touched (nor transferred).
+// Since it can't wait while holding multiple shards, ErrLocked is returned if to is locked.
+// Returns ErrNotFound if key doesn't exist.
+func (s *Store) Copy(key, to string) (l Lock, err error) {
+	defer s.evict(to) // After the shards are unlocked
+	unlock := s.lockShardsOf(key, to)
+	defer unlock()
+
+	src := s.shard(key).m[key]
+	if src == nil || src.valueExpired(time.Now()) {
+		return Lock{}, ErrNotFound
+	}
+	value, err := src.value() // Before the lock of to is acquired, it may be the same
+	if err != nil {
+		return Lock{}, err
+	}
+	contentType := src.ContentType
+
+	sh := s.shard(to)
+	vw := sh.m[to]
+	created := vw == nil
+	if created {
+		vw = newValueWr()
+		sh.m[to] = vw
+	}
+	if err := vw.TryLock(); err != nil {
+		if created {
+			delete(sh.m, to)
+		}
+		return Lock{}, err
+	}
+	if !s.fits(vw, len(value)) {
+		sh.abandon(to, vw, created)
+		return Lock{}, ErrInsufficientStorage
+	}
+	rec := putRecord(to, value, contentType, time.Time{})
+	if err := s.logMutation(rec); err != nil {
+		sh.abandon(to, vw, created)
+		return Lock{}, err
+	}
+	s.setRecord(vw, rec)
+	return vw.lock(), nil
+}
+
+// Rename moves the value of key (with its timestamps and expiry) to the key to atomically,
+// and deletes key. If to exists, ErrExists is returned unless overwrite is true.
+// Since lock holders would be orphaned, ErrLocked is returned if key or to (when overwritten)
+// is locked (or waited for). Returns ErrNotFound if key doesn't exist.
+func (s *Store) Rename(key, to string, overwrite bool) error {
+	unlock := s.lockShardsOf(key, to)
+	defer unlock()
+
+	now := time.Now()
+	sh := s.shard(key)
+	src := sh.m[key]
+	if src == nil || src.valueExpired(now) {
+		return ErrNotFound
+	}
+	if src.held || len(src.waiters) > 0 {
+		return ErrLocked
+	}
+	if key == to {
+		return nil // Nothing to move
+	}
+	dsh := s.shard(to)
+	dst := dsh.m[to]
+	if dst != nil && !dst.valueExpired(now) && !overwrite {
+		return ErrExists
+	}
+	if dst != nil && (dst.held || len(dst.waiters) > 0) {
+		return ErrLocked
+	}
+
+	value, err := src.value()
+	if err != nil {
+		return err
+	}
+	// Put first, so a failure in between (or a crash) doesn't lose the value
+	if err := s.logMutation(putRecord(to, value, src.ContentType, src.ValueExpires)); err != nil {
+		return err
+	}
+	if err := s.logMutation(walRecord{Op: OpDelete, Key: key}); err != nil {
+		return err
+	}
+	vw := newValueWr()
+	vw.data, vw.size, vw.compressed = src.data, src.size, src.compressed
+	vw.CreatedAt, vw.UpdatedAt = src.CreatedAt, src.UpdatedAt
+	vw.Version, vw.ValueExpires, vw.Accesses = src.Version, src.ValueExpires, src.Accesses
+	vw.ContentType = src.ContentType
+	if dst != nil {
+		s.dropValue(dst)
+		if vw.Version <= dst.Version {
+			vw.Version = dst.Version + 1 // So watchers of to notice the change
+		}
+		dst.notify()
+	}
+	dsh.m[to] = vw
+	delete(sh.m, key)
+	src.notify()
+	return nil
+}
+
+// PutAll sets the values of multiple keys atomically (in a single critical section),
+// acquiring their locks (keys that don't exist are created). It's all-or-nothing:
+// since it can't wait for locks, if any of the keys is locked (or handed over to
+// a waiter), nothing is set and ErrLocked is returned. Likewise if the values don't
+// fit in the memory budget, ErrInsufficientStorage is returned.
+// Returns the acquired locks mapped from key.
+func (s *Store) PutAll(values map[string]string) (map[string]Lock, error) {
+	keys := valuesKeys(values)
+	defer s.evict(keys...) // After the shards are unlocked
+	s.makeRoom(valuesSize(values), keys...)
+	s.lockAll()
+	defer s.unlockAll()
+
+	for key := range values {
+		if vw := s.shard(key).m[key]; vw != nil && (vw.held || len(vw.waiters) > 0) {
+			return nil, ErrLocked
+		}
+	}
+	if !s.fitsAll(values, false) {
+		return nil, ErrInsufficientStorage
+	}
+
+	// Acquire all locks first, so a failure (generating a lock id) leaves nothing set.
+	vws := make(map[string]*valueWr, len(values))
+	created := make(map[string]bool)
+	abandonAll := func() {
+		for key, vw := range vws {
+			s.shard(key).abandon(key, vw, created[key])
+		}
+	}
+	for key := range values {
+		sh := s.shard(key)
+		vw := sh.m[key]
+		if vw == nil {
+			vw = newValueWr()
+			sh.m[key] = vw
+			created[key] = true
+		}
+		if err := vw.TryLock(); err != nil { // Not ErrLocked, we checked all keys
+			if created[key] {
+				delete(sh.m, key)
+			}
+			abandonAll()
+			return nil, err
+		}
+		vws[key] = vw
+	}
+
+	locks := make(map[string]Lock, len(values))
+	for key, value := range values {
+		rec := putRecord(key, value, "", time.Time{})
+		if err := s.logMutation(rec); err != nil {
+			// The WAL failed: values logged (and set) so far remain set
+			abandonAll()
+			return nil, err
+		}
+		vw := vws[key]
+		s.setRecord(vw, rec)
+		delete(created, key) // Set, so it must not be removed if a later key fails
+		locks[key] = vw.lock()
+	}
+	return locks, nil
+}
+
+// PutIf is like Put, but it only sets the value if key exists and its current value
+// equals expect (compare-and-swap). If the value doesn't match, the lock is not kept
+// and ErrMismatch is returned. Returns ErrNotFound if key doesn't exist (or its value has expired).
+func (s *Store) PutIf(ctx context.Context, key, value, contentType, expect string, ttl time.Duration) (l Lock, err error) {
+	return s.putIf(ctx, key, value, contentType, ttl, func(current string) error {
+		if current != expect {
+			return ErrMismatch
+		}
+		return nil
+	})
+}
+
+// PutIfMatch is like Put, but it only sets the value if key exists and the ETag of
+// its current value is one of etags ("*" matches any value). If there is no match
+// (or key doesn't exist), the lock is not kept and ErrPrecondition is returned.
+func (s *Store) PutIfMatch(ctx context.Context, key, value, contentType string, etags []string, ttl time.Duration) (l Lock, err error) {
+	l, err = s.putIf(ctx, key, value, contentType, ttl, func(current string) error {
+		tag := ETag(current)
+		for _, t := range etags {
+			if t == "*" || t == tag {
+				return nil
+			}
+		}
+		return ErrPrecondition
+	})
+	if err == ErrNotFound {
+		err = ErrPrecondition
+	}
+	return l, err
+}
+
+// putIf waits for the lock of the existing key, and sets its value if check
+// accepts the current value (returns nil). Else the lock is not kept and
+// the error of check is returned.
+func (s *Store) putIf(ctx context.Context, key, value, contentType string, ttl time.Duration, check func(current string) error) (l Lock, err error) {
+	s.makeRoom(len(value), key)
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, err := sh.lockExisting(ctx, key)
+	if err != nil {
+		return Lock{}, err
+	}
+	current, err := vw.value()
+	if err == nil {
+		err = check(current)
+	}
+	if err != nil {
+		vw.Unlock()
+		return Lock{}, err
+	}
+	if !s.fits(vw, len(value)) {
+		vw.Unlock()
+		return Lock{}, ErrInsufficientStorage
+	}
+	rec := putRecord(key, value, contentType, expiryAfter(ttl))
+	if err := s.logMutation(rec); err != nil {
+		vw.Unlock()
+		return Lock{}, err
+	}
+	s.setRecord(vw, rec)
+	vw.accessed()
+	return vw.lock(), nil
+}
+
+// Reserve acquires the lock of key, and returns its value and the lock id.
+// If wait is true, Reserve waits for key to be available, and returns ctx.Err()
+// if ctx is done before that. If wait is false and key is locked, ErrLocked is returned.
+// If ttl > 0, the lock is automatically released after ttl unless it's released
+// or renewed before that.
+// Returns ErrNotFound if key doesn't exist (or its value has expired).
+func (s *Store) Reserve(ctx context.Context, key string, wait bool, ttl time.Duration) (value string, l Lock, err error) {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	var vw *valueWr
+	if !wait {
+		// Fail fast instead of waiting for the lock
+		vw = sh.m[key]
+		if err = checkReservable(vw, false, false); err != nil {
+			return "", Lock{}, err
+		}
+		if err = vw.TryLock(); err != nil {
+			return "", Lock{}, err
+		}
+	} else {
+		// Wait to be available and acquire lock:
+		if vw, err = sh.lockExisting(ctx, key); err != nil {
+			return "", Lock{}, err
+		}
+	}
+
+	if value, err = vw.value(); err != nil {
+		vw.Unlock()
+		return "", Lock{}, err
+	}
+	if ttl > 0 {
+		vw.Expires = time.Now().Add(ttl)
+	}
+	vw.accessed()
+	return value, vw.lock(), nil
+}
+
+// ReserveAbsent creates key (with an empty value) and acquires its lock, but only if key
+// doesn't exist: it's a compare-and-acquire primitive (e.g. for leader election).
+// It never waits: returns ErrExists if key exists.
+// If ttl > 0, the lock is automatically released after ttl (the key remains).
+func (s *Store) ReserveAbsent(key string, ttl time.Duration) (l Lock, err error) {
+	defer s.evict(key) // After the shard is unlocked
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw := sh.m[key]
+	if err := checkReservable(vw, true, false); err != nil {
+		return Lock{}, err
+	}
+	created := vw == nil
+	if created {
+		vw = newValueWr()
+		sh.m[key] = vw
+	}
+	if err := vw.TryLock(); err != nil {
+		return Lock{}, err
+	}
+	rec := putRecord(key, "", "", time.Time{})
+	if err := s.logMutation(rec); err != nil {
+		sh.abandon(key, vw, created)
+		return Lock{}, err
+	}
+	s.setRecord(vw, rec)
+	if ttl > 0 {
+		vw.Expires = time.Now().Add(ttl)
+	}
+	vw.accessed()
+	return vw.lock(), nil
+}
+
+// ReserveUntil waits until the value of key equals until, then acquires its lock (like Reserve
+// with wait), and returns the lock id. The value is checked holding the lock each time it changes,
+// so a value which is overwritten before the lock is acquired (e.g. by a writer queued for
+// the lock earlier) is missed, and waiting continues.
+// Returns ErrNotFound if key doesn't exist (or is deleted while waiting),
+// and ctx.Err() if ctx is done before the lock is acquired.
+func (s *Store) ReserveUntil(ctx context.Context, key, until string, ttl time.Duration) (l Lock, err error) {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	for {
+		vw, err := sh.lockExisting(ctx, key)
+		if err != nil {
+			return Lock{}, err
+		}
+		current, err := vw.value()
+		if err != nil {
+			vw.Unlock()
+			return Lock{}, err
+		}
+		if current == until {
+			if ttl > 0 {
+				vw.Expires = time.Now().Add(ttl)
+			}
+			vw.accessed()
+			return vw.lock(), nil
+		}
+
+		// Not yet: let others (writers) have the lock, and wait for a change
+		vw.Unlock()
+		if err := vw.waitChange(ctx, &sh.mux); err != nil {
+			return Lock{}, err
+		}
+	}
+}
+
+// ReserveAll acquires the locks of all keys (see Reserve), and returns the locks mapped from key.
+// It's all-or-nothing: if any of the locks can't be acquired, the ones acquired so far
+// are released and the error is returned (e.g. ErrNotFound if any key doesn't exist).
+//
+// The locks are acquired in a canonical order (sorted keys), so concurrent ReserveAll calls
+// can't deadlock each other: no one waits for a key while holding a lock of a greater key.
+func (s *Store) ReserveAll(ctx context.Context, keys []string, wait bool, ttl time.Duration) (map[string]Lock, error) {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+
+	// Fail fast if any key is missing
+	for _, key := range keys {
+		if _, err := s.Get(key); err != nil {
+			return nil, err
+		}
+	}
+
+	locks := make(map[string]Lock, len(keys))
+	for _, key := range keys {
+		if _, ok := locks[key]; ok {
+			continue // Duplicate
+		}
+		_, l, err := s.Reserve(ctx, key, wait, ttl)
+		if err != nil {
+			for k, l := range locks {
+				s.Release(k, l.Id)
+			}
+			return nil, err
+		}
+		locks[key] = l
+	}
+	return locks, nil
+}
+
+// ReleaseAll releases the locks of multiple keys atomically, locks maps from key to lock id.
+// It's all-or-nothing: if any lock id doesn't identify the currently held lock of its key,
+// nothing is released and ErrUnauthorized is returned (ErrNotFound if any key doesn't exist).
+func (s *Store) ReleaseAll(locks map[string]string) error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	for key, lockId := range locks {
+		if _, err := s.shard(key).lockedValue(key, lockId); err != nil {
+			return err
+		}
+	}
+	for key := range locks {
+		s.shard(key).m[key].Unlock()
+	}
+	return nil
+}
+
+// ReleaseEach releases the locks of multiple keys given as lock ids mapped from key,
+// each independently: unlike ReleaseAll, a lock which can't be released (e.g. ErrUnauthorized)
+// doesn't prevent releasing the others. Returns the errors of the failed releases mapped from key.
+func (s *Store) ReleaseEach(locks map[string]string) map[string]error {
+	errs := make(map[string]error)
+	for key, lockId := range locks {
+		if err := s.Release(key, lockId); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs
+}
+
+// lockOrCreate waits for key to be available and acquires its lock, creating key
+// first if it doesn't exist (which never waits).
+// Also returns whether key was created. Returns ctx.Err() if ctx is done before
+// the lock is acquired.
+// sh.mux must be locked by the caller.
+func (sh *shard) lockOrCreate(ctx context.Context, key string) (vw *valueWr, created bool, err error) {
+	for {
+		vw = sh.m[key]
+		created = vw == nil
+		if created {
+			// Key doesn't exist yet: create
+			vw = newValueWr()
+			sh.m[key] = vw
+		}
+		// Acquire lock
+		if err = sh.lock(ctx, vw); err != nil {
+			if created {
+				// Lock of a new value never waits, so noone else has seen it: undo creation
+				delete(sh.m, key)
+			}
+			return nil, false, err
+		}
+		if sh.m[key] == vw {
+			return vw, created, nil
+		}
+		// Key was deleted while we were waiting, try again
+		vw.Unlock()
+	}
+}
+
+// lock waits for vw to be available and acquires its lock, unless sh.maxWaiters
+// are already waiting for it, in which case ErrQueueFull is returned right away.
+// sh.mux must be locked by the caller.
+func (sh *shard) lock(ctx context.Context, vw *valueWr) error {
+	if sh.maxWaiters > 0 && len(vw.waiters) >= sh.maxWaiters {
+		return ErrQueueFull
+	}
+	return vw.Lock(ctx, &sh.mux)
+}
+
+// abandon releases the lock acquired by lockOrCreate when the operation fails,
+// also removing key if it was created.
+// sh.mux must be locked by the caller (and not unlocked since lockOrCreate).
+func (sh *shard) abandon(key string, vw *valueWr, created bool) {
+	if created {
+		delete(sh.m, key)
+	}
+	vw.Unlock()
+}
+
+// lockExisting waits for the existing key to be available and acquires its lock.
+// Returns ErrNotFound if key doesn't exist (or is deleted or its value expires while waiting),
+// and ctx.Err() if ctx is done before the lock is acquired.
+// sh.mux must be locked by the caller.
+func (sh *shard) lockExisting(ctx context.Context, key string) (*valueWr, error) {
+	vw := sh.m[key]
+	if vw == nil || vw.valueExpired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	if err := sh.lock(ctx, vw); err != nil {
+		return nil, err
+	}
+	if sh.m[key] != vw || vw.valueExpired(time.Now()) {
+		// Key was deleted (or its value expired) while we were waiting
+		vw.Unlock()
+		return nil, ErrNotFound
+	}
+	return vw, nil
+}
+
+// lockedValue returns the valueWr of key if lockId identifies its currently held lock.
+// Returns ErrNotFound if key doesn't exist, and ErrUnauthorized if lockId is not valid.
+// sh.mux must be locked by the caller.
+func (sh *shard) lockedValue(key, lockId string) (*valueWr, error) {
+	vw := sh.m[key]
+	if err := checkLockHeld(vw, lockId); err != nil {
+		return nil, err
+	}
+	return vw, nil
+}
+
+// checkLockHeld checks if lockId identifies the currently held lock of a key whose valueWr
+// is vw (nil if the key doesn't exist), see lockedValue.
+// The shard of vw must be locked by the caller.
+func checkLockHeld(vw *valueWr, lockId string) error {
+	if vw == nil {
+		return ErrNotFound
+	}
+	if vw.LockId != lockId {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// checkUpdatable checks if the value of a key whose valueWr is vw (nil if the key doesn't exist)
+// can be set by the holder of lockId: lockId must identify the currently held lock,
+// and the value must not be expired (even if its lock is held).
+// The shard of vw must be locked by the caller.
+func checkUpdatable(vw *valueWr, lockId string) error {
+	if err := checkLockHeld(vw, lockId); err != nil {
+		return err
+	}
+	if vw.valueExpired(time.Now()) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkReservable checks if a reservation can acquire the lock of a key whose valueWr is vw
+// (nil if the key doesn't exist): absent tells if the key is only reserved if it doesn't
+// exist (then it's created), wait if the reservation waits for the lock.
+// Reservations waiting for the lock are checked again once they acquire it.
+// The shard of vw must be locked by the caller.
+func checkReservable(vw *valueWr, absent, wait bool) error {
+	exists := vw != nil && !vw.valueExpired(time.Now())
+	locked := vw != nil && (vw.held || len(vw.waiters) > 0)
+	switch {
+	case absent && exists:
+		return ErrExists
+	case absent && locked:
+		return ErrLocked // An expired value not yet swept may still be locked
+	case absent:
+	case !exists:
+		return ErrNotFound
+	case !wait && locked:
+		return ErrLocked
+	}
+	return nil
+}
+
+// Update sets the value of key (with contentType as its content type, may be empty),
+// and releases its lock if release is true.
+// lockId must identify the currently held lock of key.
+// Returns ErrNotFound if the value has expired (even if its lock is held).
+func (s *Store) Update(key, lockId, value, contentType string, release bool) error {
+	s.makeRoom(len(value), key)
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw := sh.m[key]
+	if err := checkUpdatable(vw, lockId); err != nil {
+		return err
+	}
+	if !s.fits(vw, len(value)) {
+		return ErrInsufficientStorage
+	}
+	rec := putRecord(key, value, contentType, vw.ValueExpires)
+	if err := s.logMutation(rec); err != nil {
+		return err
+	}
+	s.setRecord(vw, rec)
+	if release {
+		vw.Unlock()
+	}
+	return nil
+}
+
+// SetOwner sets the owner of the lock of key identified by lockId: the identity
+// of the holder, for operators to see who holds the lock. It's informational only,
+// it's cleared when the lock is released.
+func (s *Store) SetOwner(key, lockId, owner string) error {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, err := sh.lockedValue(key, lockId)
+	if err != nil {
+		return err
+	}
+	vw.Owner = owner
+	return nil
+}
+
+// Release releases the lock of key, lockId must identify the currently held lock.
+func (s *Store) Release(key, lockId string) error {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, err := sh.lockedValue(key, lockId)
+	if err != nil {
+		return err
+	}
+	vw.Unlock()
+	return nil
+}
+
+// DeleteIf deletes key if its current value equals expect (compare-and-delete).
+// It waits for key to be available (like Put), so it doesn't delete keys from under
+// lock holders. Returns ErrMismatch if the value doesn't match, and ErrNotFound if key
+// doesn't exist (or is deleted or its value expires while waiting).
+func (s *Store) DeleteIf(ctx context.Context, key, expect string) error {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, err := sh.lockExisting(ctx, key)
+	if err != nil {
+		return err
+	}
+	current, err := vw.value()
+	if err != nil {
+		vw.Unlock()
+		return err
+	}
+	if current != expect {
+		vw.Unlock()
+		return ErrMismatch
+	}
+	if err := s.logMutation(walRecord{Op: OpDelete, Key: key}); err != nil {
+		vw.Unlock()
+		return err
+	}
+	delete(sh.m, key)
+	s.dropValue(vw)
+	vw.Unlock()
+	vw.notify()
+	return nil
+}
+
+// Flush deletes all keys. Returns the number of deleted keys.
+// Holders of locks of the deleted keys will find their lock ids invalid,
+// and waiters for the locks will find the keys gone.
+func (s *Store) Flush() (int, error) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	if err := s.logMutation(walRecord{Op: OpFlush}); err != nil {
+		return 0, err
+	}
+	return s.clear(), nil
+}
+
+// DeletePrefix deletes the keys starting with prefix, except for the locked ones (and the ones
+// being waited for), which are skipped. Returns the number of deleted and of skipped keys.
+func (s *Store) DeletePrefix(prefix string) (deleted, skipped int, err error) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	for _, sh := range s.shards {
+		for key, vw := range sh.m {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if vw.held || len(vw.waiters) > 0 {
+				skipped++
+				continue
+			}
+			if err := s.logMutation(walRecord{Op: OpDelete, Key: key}); err != nil {
+				return deleted, skipped, err
+			}
+			delete(sh.m, key)
+			s.dropValue(vw)
+			vw.notify()
+			deleted++
+		}
+	}
+	return deleted, skipped, nil
+}
+
+// clear deletes all keys, releasing their locks so waiters (if any) can proceed
+// and notice the keys are gone. Returns the number of deleted keys.
+// All shards must be locked by the caller.
+func (s *Store) clear() (n int) {
+	for _, sh := range s.shards {
+		n += len(sh.m)
+		for key, vw := range sh.m {
+			delete(sh.m, key)
+			s.dropValue(vw)
+			vw.Unlock()
+			vw.notify()
+		}
+	}
+	return n
+}
+
+// ForceUnlock releases the lock of key regardless of who holds it.
+// Meant for operators to recover locks of dead clients.
+// Also returns whether key was locked. Returns ErrNotFound if key doesn't exist.
+func (s *Store) ForceUnlock(key string) (locked bool, err error) {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw := sh.m[key]
+	if vw == nil {
+		return false, ErrNotFound
+	}
+	locked = vw.LockId != ""
+	vw.Unlock()
+	return locked, nil
+}
+
+// Delete deletes key, lockId must identify the currently held lock.
+func (s *Store) Delete(key, lockId string) error {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw, err := sh.lockedValue(key, lockId)
+	if err != nil {
+		return err
+	}
+	if err := s.logMutation(walRecord{Op: OpDelete, Key: key}); err != nil {
+		return err
+	}
+	delete(sh.m, key)
+	s.dropValue(vw)
+	// Release the lock so waiters (if any) can proceed and notice the key is gone.
+	vw.Unlock()
+	vw.notify()
+	return nil
+}
+
+// Renew resets the expiry of the lock of key identified by lockId
+// to expire ttl from now.
+// Returns ErrExpired if the lock has already expired and was released.
+func (s *Store) Renew(key, lockId string, ttl time.Duration) error {
+	sh := s.shard(key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	vw := sh.m[key]
+	if vw == nil {
+		return ErrNotFound
+	}
+	if vw.LockId == lockId && vw.expired(time.Now()) {
+		// Expired but not yet swept: reclaim it now
+		vw.releaseExpired()
+	}
+	if vw.LockId != lockId {
+		if lockId != "" && vw.ExpiredLockId == lockId {
+			return ErrExpired
+		}
+		return ErrUnauthorized
+	}
+	vw.Expires = time.Now().Add(ttl)
+	return nil
+}
+
+// Meta holds metadata of a key.
+type Meta struct {
+	CreatedAt   time.Time `json:"created_at"`             // Time when the key was created
+	UpdatedAt   time.Time `json:"updated_at"`             // Time when the value was last set
+	Locked      bool      `json:"locked"`                 // Tells if the key is currently locked
+	ValueLength int       `json:"value_length"`           // Length of the value in bytes
+	Empty       bool      `json:"empty"`                  // Tells if the value is empty (the key exists nevertheless)
+	Version     uint64    `json:"version"`                // Version of the value
+	Owner       string    `json:"owner,omitempty"`        // Owner of the lock (if locked and the holder told it)
+	ContentType string    `json:"content_type,omitempty"` // Content type of the value (if set with one)
+}
+
+// Meta returns the metadata of key, and whether key exists.
+// Meta does not touch the lock of the value, so it never waits.
+func (s *Store) Meta(key string) (meta Meta, ok bool) {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	vw := sh.m[key]
+	if vw == nil || vw.valueExpired(time.Now()) {
+		return Meta{}, false
+	}
+	return Meta{
+		CreatedAt:   vw.CreatedAt,
+		UpdatedAt:   vw.UpdatedAt,
+		Locked:      vw.LockId != "",
+		ValueLength: vw.size,
+		Empty:       vw.size == 0,
+		Version:     vw.Version,
+		Owner:       vw.Owner,
+		ContentType: vw.ContentType,
+	}, true
+}
+
+// Watch waits until the version of the value of key differs from since, and returns
+// the value and its version. Since versions start at 1, since=0 returns the current
+// value immediately.
+// Returns ErrNotFound if key doesn't exist (or is deleted while waiting),
+// and ctx.Err() if ctx is done before the value changes.
+// Watch does not touch the lock of the value.
+func (s *Store) Watch(ctx context.Context, key string, since uint64) (value string, version uint64, err error) {
+	sh := s.shard(key)
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+
+	for {
+		vw := sh.m[key]
+		if vw == nil || vw.valueExpired(time.Now()) {
+			return "", 0, ErrNotFound
+		}
+		if vw.Version != since {
+			if value, err = vw.value(); err != nil {
+				return "", 0, err
+			}
+			return value, vw.Version, nil
+		}
+		// Value set or key deleted meanwhile: check again
+		if err := vw.waitChange(ctx, sh.mux.RLocker()); err != nil {
+			return "", 0, err
+		}
+	}
+}
+
+// Stats holds statistics about the store.
+type Stats struct {
+	Keys       int `json:"keys"`        // Number of keys
+	LockedKeys int `json:"locked_keys"` // Number of keys currently locked
+	ValueBytes int `json:"value_bytes"` // Total size of values in bytes (uncompressed)
+
+	CompressedValues int `json:"compressed_values,omitempty"`       // Number of values stored compressed
+	CompressionSaved int `json:"compression_saved_bytes,omitempty"` // Memory saved by compressing values in bytes
+
+	Evictions uint64 `json:"evictions"` // Number of keys evicted by LRU eviction
+
+	Waiters     map[string]int `json:"waiters,omitempty"` // Number of waiters for the lock by key (keys having waiters only)
+	LockWaiting int64          `json:"lock_waiting"`      // Number of goroutines currently waiting for locks
+
+	Owners map[string]string `json:"owners,omitempty"` // Owners of the locks by key (locks whose holder told it only)
+
+	// LongHeld is the time (in seconds) the locks held longer than the watchdog threshold
+	// have been held by key (only if the watchdog is enabled).
+	LongHeld map[string]float64 `json:"long_held_locks,omitempty"`
+
+	Replication *ReplicationStats `json:"replication,omitempty"` // State of the replication (read replicas only)
+}
+
+// Stats returns statistics about the store.
+func (s *Store) Stats() (stats Stats) {
+	for _, sh := range s.shards {
+		sh.mux.RLock()
+		stats.Keys += len(sh.m)
+		for key, vw := range sh.m {
+			if vw.LockId != "" {
+				stats.LockedKeys++
+			}
+			if vw.Owner != "" {
+				if stats.Owners == nil {
+					stats.Owners = make(map[string]string)
+				}
+				stats.Owners[key] = vw.Owner
+			}
+			if len(vw.waiters) > 0 {
+				if stats.Waiters == nil {
+					stats.Waiters = make(map[string]int)
+				}
+				stats.Waiters[key] = len(vw.waiters)
+			}
+			stats.ValueBytes += vw.size
+			if vw.compressed {
+				stats.CompressedValues++
+				stats.CompressionSaved += vw.size - len(vw.data)
+			}
+			if s.watchdog > 0 && vw.LockId != "" {
+				if held := time.Since(vw.LockedAt); held > s.watchdog {
+					if stats.LongHeld == nil {
+						stats.LongHeld = make(map[string]float64)
+					}
+					stats.LongHeld[key] = held.Seconds()
+				}
+			}
+		}
+		sh.mux.RUnlock()
+	}
+	stats.Evictions = atomic.LoadUint64(&s.evictions)
+	stats.LockWaiting = atomic.LoadInt64(&lockWaiting)
+	return
+}
+
+// Healthy reports whether all shards of the store can be locked for reading
+// within timeout. If not, a shard mutex is most likely stuck.
+func (s *Store) Healthy(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for _, sh := range s.shards {
+		for !sh.mux.TryRLock() {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+		sh.mux.RUnlock()
+	}
+	return true
+}
+
+// sweepExpiredLocks releases expired locks periodically, checking every interval.
+// It never returns, should be launched as a new goroutine.
+func (s *Store) sweepExpiredLocks(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, sh := range s.shards {
+			sh.mux.Lock()
+			now := time.Now()
+			for key, vw := range sh.m {
+				if vw.expired(now) {
+					log.Printf("Lock on key %q expired, releasing it.", key)
+					vw.releaseExpired()
+				}
+			}
+			sh.mux.Unlock()
+		}
+	}
+}
+
+// valueSweepBatch is the max number of expired values deleted while holding a shard lock.
+const valueSweepBatch = 1000
+
+// sweepExpiredValues deletes the keys whose values have expired periodically, checking every interval.
+// Locked keys are skipped (they are deleted by a later sweep after they're unlocked).
+// It never returns, should be launched as a new goroutine.
+func (s *Store) sweepExpiredValues(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, sh := range s.shards {
+			// Delete in batches, so the shard isn't locked for long
+			for s.sweepExpiredBatch(sh) == valueSweepBatch {
+			}
+		}
+	}
+}
+
+// sweepExpiredBatch deletes at most valueSweepBatch expired values of sh.
+// Returns the number of deleted values.
+func (s *Store) sweepExpiredBatch(sh *shard) (n int) {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	now := time.Now()
+	for key, vw := range sh.m {
+		if !vw.valueExpired(now) || vw.held || len(vw.waiters) > 0 {
+			continue
+		}
+		if err := s.logMutation(walRecord{Op: OpDelete, Key: key}); err != nil {
+			return n
+		}
+		delete(sh.m, key)
+		s.dropValue(vw)
+		vw.notify()
+		if n++; n == valueSweepBatch {
+			break
+		}
+	}
+	return n
+}
+
+// genLockId generates a new, unique lock id.
+// An error is returned if the secure random source fails (in which case
+// no degenerate, guessable id is returned).
+func genLockId() (string, error) {
+	buf, err := randomBytes(lockIdLength)
+	if err != nil {
+		return "", err
+	}
+	if lockIdEncoding == LockIdBase64 {
+		return base64.RawURLEncoding.EncodeToString(buf), nil
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// randReader is the secure random source (replaceable in tests).
+var randReader io.Reader = rand.Reader
+
+// randomBytes returns n bytes read from the secure random source.
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(randReader, buf); err != nil {
+		log.Println("Error reading secure random:", err)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// wellFormedLockId tells if lockId has the length and encoding of the generated lock ids.
+func wellFormedLockId(lockId string) bool {
+	var buf []byte
+	var err error
+	if lockIdEncoding == LockIdBase64 {
+		buf, err = base64.RawURLEncoding.DecodeString(lockId)
+	} else {
+		buf, err = hex.DecodeString(lockId)
+	}
+	return err == nil && len(buf) == lockIdLength
+}
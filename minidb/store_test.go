@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreShards(t *testing.T) {
+	if n := len(NewStore(0).shards); n != 1 {
+		t.Errorf("Got %d shards for 0, want 1", n)
+	}
+
+	s := NewStore(8)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("k", i)
+		if _, _, err := s.Put(ctx, key, "v", "", 0); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	used, total := 0, 0
+	for i, sh := range s.shards {
+		for key := range sh.m {
+			if s.shard(key) != sh {
+				t.Errorf("Key %s is in shard %d, not in the shard of its hash", key, i)
+			}
+		}
+		if len(sh.m) > 0 {
+			used++
+		}
+		total += len(sh.m)
+	}
+	if total != 100 {
+		t.Errorf("Got %d keys in shards, want 100", total)
+	}
+	if used < 2 {
+		t.Errorf("Keys are not distributed, only %d shards used", used)
+	}
+}
+
+// BenchmarkStoreParallel compares the throughput of a single-mutex store (1 shard)
+// with the sharded store, each goroutine locking and releasing its own keys.
+func BenchmarkStoreParallel(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprint("shards=", shards), func(b *testing.B) {
+			s := NewStore(shards)
+			ctx := context.Background()
+			var goroutines int64
+			b.RunParallel(func(pb *testing.PB) {
+				id := atomic.AddInt64(&goroutines, 1)
+				for i := 0; pb.Next(); i++ {
+					key := fmt.Sprint(id, "-", i%100)
+					l, _, err := s.Put(ctx, key, "v", "", 0)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := s.Release(key, l.Id); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// failingReader is an io.Reader which always fails.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("entropy source failed")
+}
+
+func TestLockIdRandFailure(t *testing.T) {
+	s := newTestServer()
+	lockId := put(t, s, "a", "1")
+	if err := s.store.Release("a", lockId); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	defer func(r io.Reader) { randReader = r }(randReader)
+	randReader = failingReader{}
+
+	if id, err := genLockId(); err == nil {
+		t.Errorf("Got lock id %q, want error", id)
+	}
+	if w := do(s, http.MethodPost, PathReservations+"a", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("Reserve: got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if w := do(s, http.MethodPut, PathValues+"b", "1"); w.Code != http.StatusInternalServerError {
+		t.Errorf("PUT: got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if _, err := s.store.Get("b"); err != ErrNotFound {
+		t.Error("Key is created without a lock id")
+	}
+
+	randReader = rand.Reader
+	if w := do(s, http.MethodPost, PathReservations+"a?wait=false", ""); w.Code != http.StatusOK {
+		t.Errorf("Key is left locked without a lock id (status %d)", w.Code)
+	}
+}
+
+func TestReserveFIFO(t *testing.T) {
+	const n = 50
+	srv := newTestServer()
+	s := srv.store
+	ctx := context.Background()
+	first, _, err := s.Put(ctx, "a", "v", "", 0)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	order := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			_, l, err := s.Reserve(ctx, "a", true, 0)
+			if err != nil {
+				t.Errorf("Reserve %d: %v", i, err)
+				return
+			}
+			order <- i
+			s.Release("a", l.Id)
+		}(i)
+		// Queue the waiters in a known order.
+		waitUntil(t, func() bool { return waiters(s, "a") == i+1 })
+	}
+
+	w := do(srv, http.MethodGet, PathStats, "")
+	var stats Stats
+	decode(t, w, &stats)
+	if stats.Waiters["a"] != n {
+		t.Errorf("Got queue depth %d in stats, want %d", stats.Waiters["a"], n)
+	}
+
+	if err := s.Release("a", first.Id); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	for want := 0; want < n; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("Waiter %d got the lock, want %d", got, want)
+		}
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	s := newTestServer()
+	for i, key := range []string{"a", "b", "c", "d"} {
+		if err := s.store.Release(key, put(t, s, key, "v")); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < i; j++ {
+			s.store.Get(key)
+		}
+	}
+	got := s.store.HotKeys(2)
+	if len(got) != 2 || got[0].Key != "d" || got[1].Key != "c" || got[0].Accesses <= got[1].Accesses {
+		t.Errorf("Got hot keys %v, want d and c, most accessed first", got)
+	}
+	if got := s.store.HotKeys(10); len(got) != 4 {
+		t.Errorf("Got %d hot keys, want %d", len(got), 4)
+	}
+}
+
+func TestLocksOldest(t *testing.T) {
+	s := newTestServer()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		lockId := put(t, s, key, "v")
+		if key == "b" {
+			if err := s.store.Release(key, lockId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(time.Millisecond) // Distinct lock times
+	}
+	got := s.store.Locks(2)
+	if len(got) != 2 || got[0].Key != "a" || got[1].Key != "c" {
+		t.Errorf("Got locks %v, want a and c, oldest first", got)
+	}
+	if got := s.store.Locks(10); len(got) != 3 {
+		t.Errorf("Got %d locks, want %d", len(got), 3)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// topN keeps the best n of the items offered to it, so only n items are kept in memory
+// no matter how many are offered. The kept items are in a heap with the worst one on top,
+// so it can be replaced cheaply. It implements heap.Interface (for its own use).
+type topN struct {
+	n     int
+	items []interface{}
+	less  func(a, b interface{}) bool // Tells if a is worse than b
+}
+
+// newTopN creates a new topN keeping the best n items by less (which tells if a is worse than b).
+func newTopN(n int, less func(a, b interface{}) bool) *topN {
+	return &topN{n: n, items: make([]interface{}, 0, n), less: less}
+}
+
+func (t *topN) Len() int           { return len(t.items) }
+func (t *topN) Less(i, j int) bool { return t.less(t.items[i], t.items[j]) }
+func (t *topN) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topN) Push(x interface{}) { t.items = append(t.items, x) }
+func (t *topN) Pop() interface{} {
+	x := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return x
+}
+
+// accepts tells if x would be kept if offered (it's better than the worst kept item,
+// or there are less than n items kept).
+func (t *topN) accepts(x interface{}) bool {
+	return len(t.items) < t.n || (t.n > 0 && t.less(t.items[0], x))
+}
+
+// offer offers x, it's kept if accepted (see accepts), replacing the worst kept item if needed.
+func (t *topN) offer(x interface{}) {
+	switch {
+	case len(t.items) < t.n:
+		heap.Push(t, x)
+	case t.accepts(x):
+		t.items[0] = x
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the kept items, best first.
+func (t *topN) sorted() []interface{} {
+	sort.Slice(t.items, func(i, j int) bool { return t.less(t.items[j], t.items[i]) })
+	return t.items
+}
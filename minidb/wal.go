@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Operations of WAL records.
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+	OpFlush  = "flush" // Deletion of all keys
+)
+
+// walRecord is a record of the write-ahead log, describing a mutation of the store.
+type walRecord struct {
+	Op          string     `json:"op"`                     // Operation, OpPut, OpDelete or OpFlush
+	Key         string     `json:"key"`                    // Key being mutated (empty for OpFlush)
+	Value       string     `json:"value,omitempty"`        // New value (OpPut)
+	ContentType string     `json:"content_type,omitempty"` // Content type of the new value (OpPut), if it has one
+	Expires     *time.Time `json:"expires,omitempty"`      // Time when the new value expires (OpPut), nil if it never expires
+}
+
+// putRecord returns the OpPut record of setting the value of key to value with the given
+// content type, expiring at expires (never if it's the zero value).
+func putRecord(key, value, contentType string, expires time.Time) walRecord {
+	return walRecord{Op: OpPut, Key: key, Value: value, ContentType: contentType, Expires: timePtr(expires)}
+}
+
+// timePtr returns a pointer to t, or nil if t is the zero value.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// timeOf returns *t, or the zero value if t is nil.
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// maxWALRecordSize is the max size of a WAL record, larger lengths indicate a corrupt log.
+const maxWALRecordSize = 1 << 30
+
+// WAL is an append-only write-ahead log of the mutations of the store,
+// used for durability between snapshots.
+//
+// Each record is written as its length (4 bytes, big endian) followed by
+// the JSON encoding of the record.
+//
+// Its methods are safe for concurrent use.
+type WAL struct {
+	mux   sync.Mutex
+	f     *os.File // The log file
+	sync  bool     // Tells if the file is synced after each record
+	dirty bool     // Tells if records were written since the last sync
+}
+
+// OpenWAL opens the write-ahead log at path, creating it if it doesn't exist.
+//
+// Existing records are replayed by passing them to apply. If the last record is
+// incomplete or corrupt (e.g. the server crashed while writing it), it is skipped
+// and cut off the log.
+//
+// If syncInterval is 0, the file is synced after each record, else it is synced
+// periodically (in batches) every syncInterval.
+//
+// Returns the number of replayed records.
+func OpenWAL(path string, syncInterval time.Duration, apply func(rec walRecord)) (*WAL, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n, offset, err := replayWAL(f, apply)
+	if err != nil {
+		log.Printf("Skipping corrupt tail of WAL %s at offset %d: %v", path, offset, err)
+		if err = f.Truncate(offset); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	w := &WAL{f: f, sync: syncInterval == 0}
+	if syncInterval > 0 {
+		go w.syncLoop(syncInterval)
+	}
+	return w, n, nil
+}
+
+// replayWAL reads the records of the log from r and passes them to apply.
+// Returns the number of replayed records and the offset of the end of the last valid record.
+// A non-nil error is returned if an incomplete or corrupt record is encountered.
+func replayWAL(r io.Reader, apply func(rec walRecord)) (n int, offset int64, err error) {
+	br := bufio.NewReader(r)
+	var lenBuf [4]byte
+	for {
+		if _, err = io.ReadFull(br, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return n, offset, nil // Clean end of log
+			}
+			return n, offset, err
+		}
+		size := binary.BigEndian.Uint32(lenBuf[:])
+		if size > maxWALRecordSize {
+			return n, offset, fmt.Errorf("invalid record size: %d", size)
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(br, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, offset, err
+		}
+		var rec walRecord
+		if err = json.Unmarshal(data, &rec); err != nil {
+			return n, offset, err
+		}
+		if rec.Op != OpPut && rec.Op != OpDelete && rec.Op != OpFlush {
+			return n, offset, fmt.Errorf("invalid record operation: %q", rec.Op)
+		}
+		apply(rec)
+		n++
+		offset += int64(len(lenBuf)) + int64(size)
+	}
+}
+
+// Append appends a record to the log.
+func (w *WAL) Append(rec walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.f == nil {
+		return errors.New("WAL is closed")
+	}
+	if _, err := w.f.Write(buf); err != nil {
+		return err
+	}
+	if w.sync {
+		return w.f.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// Truncate discards all records of the log. It should be called after the records
+// are folded into a snapshot.
+func (w *WAL) Truncate() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.f == nil {
+		return errors.New("WAL is closed")
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// Close syncs and closes the log.
+func (w *WAL) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Sync()
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	w.f = nil
+	return err
+}
+
+// syncLoop syncs the log every interval if records were written since the last sync.
+// It returns when the log is closed, should be launched as a new goroutine.
+func (w *WAL) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.mux.Lock()
+		if w.f == nil {
+			w.mux.Unlock()
+			return
+		}
+		if w.dirty {
+			if err := w.f.Sync(); err != nil {
+				log.Println("Failed to sync WAL:", err)
+			} else {
+				w.dirty = false
+			}
+		}
+		w.mux.Unlock()
+	}
+}
+
+// OpenWAL opens the write-ahead log at path (see the OpenWAL function), replaying its records
+// into the store, and attaches it so subsequent mutations are logged.
+// Returns the number of replayed records.
+func (s *Store) OpenWAL(path string, syncInterval time.Duration) (int, error) {
+	w, n, err := OpenWAL(path, syncInterval, s.apply)
+	if err != nil {
+		return 0, err
+	}
+	s.wal = w
+	return n, nil
+}
+
+// CloseWAL closes the attached write-ahead log (if any).
+// Should only be called when the store is no longer used.
+func (s *Store) CloseWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Close()
+}
+
+// apply applies the mutation described by a replayed WAL record.
+func (s *Store) apply(rec walRecord) {
+	s.trackMutation(rec)
+	if rec.Op == OpFlush {
+		s.lockAll()
+		s.clear()
+		s.unlockAll()
+		return
+	}
+
+	sh := s.shard(rec.Key)
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	switch rec.Op {
+	case OpPut:
+		vw := sh.m[rec.Key]
+		if vw == nil {
+			vw = newValueWr()
+			sh.m[rec.Key] = vw
+		}
+		s.setRecord(vw, rec)
+	case OpDelete:
+		if vw := sh.m[rec.Key]; vw != nil {
+			delete(sh.m, rec.Key)
+			s.dropValue(vw)
+			vw.notify()
+		}
+	}
+}
+
+// setRecord sets the value of vw with its content type and expiry as described by
+// the OpPut record rec, so the store matches its log.
+// The shard of vw must be locked by the caller.
+func (s *Store) setRecord(vw *valueWr, rec walRecord) {
+	s.setValue(vw, rec.Value)
+	vw.ContentType = rec.ContentType
+	vw.ValueExpires = timeOf(rec.Expires)
+}
+
+// logMutation appends rec to the write-ahead log if one is attached,
+// and publishes its event (and tracks it for LRU eviction) if that succeeds.
+// Must be called before the mutation is applied (while the shard of the key is locked,
+// or all shards for OpFlush),
+// and the mutation must be applied if it succeeds.
+func (s *Store) logMutation(rec walRecord) error {
+	if s.wal != nil {
+		if err := s.wal.Append(rec); err != nil {
+			log.Println("Failed to write WAL:", err)
+			return err
+		}
+	}
+	s.events.publish(rec)
+	s.trackMutation(rec)
+	return nil
+}
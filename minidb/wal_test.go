@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openWALServer creates a test server whose store replays and attaches the WAL at path.
+func openWALServer(t *testing.T, path string) (*Server, int) {
+	t.Helper()
+	s := newTestServer()
+	n, err := s.store.OpenWAL(path, 0)
+	if err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	t.Cleanup(func() { s.store.CloseWAL() })
+	return s, n
+}
+
+func TestWALReplayCorruptTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s, _ := openWALServer(t, path)
+	put(t, s, "a", "1")
+	lockId := put(t, s, "b", "2")
+	if w := do(s, http.MethodDelete, PathValues+"b/"+lockId, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: got status %d", w.Code)
+	}
+	s.store.CloseWAL()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash while writing a record: length prefix without the full record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 100, '{', '"', 'o'})
+	f.Close()
+
+	s, n := openWALServer(t, path)
+	if n != 3 {
+		t.Errorf("Replayed %d records, want 3", n)
+	}
+	if value, err := s.store.Get("a"); err != nil || value != "1" {
+		t.Errorf("Got value %q (%v) for a, want %q", value, err, "1")
+	}
+	if _, err := s.store.Get("b"); err != ErrNotFound {
+		t.Errorf("Got error %v for deleted b, want %v", err, ErrNotFound)
+	}
+	if fi2, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if fi2.Size() != fi.Size() {
+		t.Errorf("Corrupt tail is not cut off the log (size: %d, want %d)", fi2.Size(), fi.Size())
+	}
+
+	// Records appended after the cut must replay too.
+	put(t, s, "c", "3")
+	s.store.CloseWAL()
+	s, _ = openWALServer(t, path)
+	if value, err := s.store.Get("c"); err != nil || value != "3" {
+		t.Errorf("Got value %q (%v) for c, want %q", value, err, "3")
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	dir := t.TempDir()
+	walPath, snapshotPath := filepath.Join(dir, "wal"), filepath.Join(dir, "snapshot.json")
+	s, _ := openWALServer(t, walPath)
+	put(t, s, "a", "1")
+	if err := s.store.SaveSnapshot(snapshotPath); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	if fi, err := os.Stat(walPath); err != nil || fi.Size() != 0 {
+		t.Fatalf("WAL is not truncated by compaction (%v)", err)
+	}
+	put(t, s, "b", "2")
+	s.store.CloseWAL()
+
+	s = newTestServer()
+	if _, err := s.store.LoadSnapshot(snapshotPath); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if n, err := s.store.OpenWAL(walPath, 0); err != nil || n != 1 {
+		t.Fatalf("OpenWAL: replayed %d records (%v), want 1", n, err)
+	}
+	defer s.store.CloseWAL()
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if value, err := s.store.Get(key); err != nil || value != want {
+			t.Errorf("Got value %q (%v) for %s, want %q", value, err, key, want)
+		}
+	}
+}
+
+func TestWALReplayTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	s, _ := openWALServer(t, path)
+	ctx := context.Background()
+	if _, _, err := s.store.Put(ctx, "a", `{"x":1}`, "application/json", time.Hour); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, _, err := s.store.Put(ctx, "b", "2", "", time.Nanosecond); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	expires := valueExpires(s.store, "a")
+	s.store.CloseWAL()
+
+	s, _ = openWALServer(t, path)
+	if got := valueExpires(s.store, "a"); !got.Equal(expires) {
+		t.Errorf("Got expiry %v for a, want %v", got, expires)
+	}
+	if meta, _ := s.store.Meta("a"); meta.ContentType != "application/json" {
+		t.Errorf("Got content type %q for a, want %q", meta.ContentType, "application/json")
+	}
+	if _, err := s.store.Get("b"); err != ErrNotFound {
+		t.Errorf("Got error %v for expired b, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// EnableWatchdog enables the lock watchdog: locks held longer than threshold are logged
+// (once per lock) and reported in Stats, and if forceRelease is true, they are also released
+// (like expired locks, so their holders get ErrExpired). This is independent of lock TTLs,
+// it's meant to diagnose (or recover from) stuck clients.
+// It must be called before the store is used, and watchLocks must be launched.
+func (s *Store) EnableWatchdog(threshold time.Duration, forceRelease bool) {
+	s.watchdog, s.watchdogRelease = threshold, forceRelease
+}
+
+// watchLocks checks the locks held longer than the watchdog threshold periodically,
+// checking every interval. It never returns, should be launched as a new goroutine.
+func (s *Store) watchLocks(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, sh := range s.shards {
+			sh.mux.Lock()
+			now := time.Now()
+			for key, vw := range sh.m {
+				if vw.LockId == "" || now.Sub(vw.LockedAt) <= s.watchdog {
+					continue
+				}
+				if s.watchdogRelease {
+					log.Printf("Lock on key %q held for %v, force-releasing it.", key, now.Sub(vw.LockedAt))
+					vw.releaseExpired()
+				} else if !vw.warned {
+					log.Printf("Lock on key %q held for %v.", key, now.Sub(vw.LockedAt))
+					vw.warned = true
+				}
+			}
+			sh.mux.Unlock()
+		}
+	}
+}